@@ -0,0 +1,142 @@
+package budgetchat
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// botAddr stands in for the address of bots, which have no connection.
+const botAddr = "bot"
+
+// botSayQueueSize is how many lines a bot can have waiting to be broadcast
+// before more are dropped.
+const botSayQueueSize = 64
+
+// Bot is an in-process member of the room. Start is called once when the bot
+// joins with a function it can use to speak, at any time and from any
+// goroutine. HandleEvent is then called for every join, leave and message the
+// bot sees. A panic in either is logged and otherwise ignored.
+type Bot interface {
+	Name() Name
+	Start(say func(text string))
+	HandleEvent(ev Event)
+}
+
+// AddBot joins bot to the room. It shows up in the roster like any other user.
+func (s *Server) AddBot(bot Bot) error {
+	name, err := s.validateName(string(bot.Name()))
+	if err != nil {
+		return fmt.Errorf("bot %q: %w", bot.Name(), err)
+	}
+
+	client := s.newClient(name, botAddr)
+	client.limiter = nil
+	if _, _, err := s.join(client); err != nil {
+		return fmt.Errorf("bot %q: %w", bot.Name(), err)
+	}
+
+	// A bot can take as long as it likes over an event, and say things from
+	// inside HandleEvent, without holding up the room. Events wait in the
+	// client's queue like anyone else's, so a bot that falls too far behind is
+	// kicked, and what it says waits in said until it is broadcast.
+	left := make(chan struct{})
+	said := make(chan string, botSayQueueSize)
+	go func() {
+		for {
+			select {
+			case text := <-said:
+				s.broadcast(client, text)
+			case <-left:
+				return
+			}
+		}
+	}()
+	say := func(text string) {
+		select {
+		case said <- text:
+		case <-left:
+		default:
+			log.Printf("bot %s is saying too much, dropping %q", name, text)
+		}
+	}
+	safelyRunBot(name, func() { bot.Start(say) })
+
+	go func() {
+		reason := <-client.Kicked
+		log.Printf("bot %s kicked: %s", name, reason)
+		s.leave(client)
+		close(left)
+	}()
+	go func() {
+		for {
+			select {
+			case ev := <-client.Inbox:
+				safelyRunBot(name, func() { bot.HandleEvent(ev) })
+			case <-left:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func safelyRunBot(name Name, fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("bot %s panicked: %v\n%s", name, err, debug.Stack())
+		}
+	}()
+	fn()
+}
+
+var diceRegex = regexp.MustCompile(`^!roll(?:\s+(\d*)d(\d+))?\s*$`)
+
+// DiceBot answers "!roll" and "!roll NdM" with dice rolls.
+type DiceBot struct {
+	say func(string)
+}
+
+func (b *DiceBot) Name() Name {
+	return "dicebot"
+}
+
+func (b *DiceBot) Start(say func(string)) {
+	b.say = say
+}
+
+func (b *DiceBot) HandleEvent(ev Event) {
+	if ev.Kind != EventMessage {
+		return
+	}
+	match := diceRegex.FindStringSubmatch(strings.TrimSpace(ev.Text))
+	if match == nil {
+		return
+	}
+
+	count, sides := 1, 6
+	if match[1] != "" {
+		count, _ = strconv.Atoi(match[1])
+	}
+	if match[2] != "" {
+		sides, _ = strconv.Atoi(match[2])
+	}
+	if count < 1 || count > 100 || sides < 1 || sides > 1000 {
+		b.say(fmt.Sprintf("%s: try between 1 and 100 dice with up to 1000 sides", ev.Sender))
+		return
+	}
+
+	rolls := make([]string, 0, count)
+	total := 0
+	for i := 0; i < count; i++ {
+		roll := rand.Intn(sides) + 1
+		total += roll
+		rolls = append(rolls, strconv.Itoa(roll))
+	}
+	b.say(fmt.Sprintf("%s rolled %dd%d: %s = %d", ev.Sender, count, sides, strings.Join(rolls, " + "), total))
+}
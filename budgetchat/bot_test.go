@@ -0,0 +1,129 @@
+package budgetchat
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type panickyBot struct {
+	say func(string)
+}
+
+func (b *panickyBot) Name() Name { return "panicky" }
+
+func (b *panickyBot) Start(say func(string)) { b.say = say }
+
+func (b *panickyBot) HandleEvent(ev Event) {
+	if ev.Kind == EventMessage && ev.Text == "boom" {
+		panic("boom")
+	}
+	if ev.Kind == EventMessage {
+		b.say("heard " + ev.Text)
+	}
+}
+
+func TestBots(t *testing.T) {
+	s := NewServer()
+	assert.Nil(t, s.AddBot(&DiceBot{}))
+	assert.Nil(t, s.AddBot(&panickyBot{}))
+	assert.ErrorIs(t, s.AddBot(&DiceBot{}), ErrNameInUse)
+	addr := startServer(t, s)
+
+	alice, roster := join(t, addr, "alice")
+	assert.ElementsMatch(t, []string{"dicebot", "panicky"}, strings.Split(strings.TrimPrefix(roster, "* The room contains: "), ", "))
+
+	alice.send(t, "boom")
+	alice.send(t, "!roll 3d1")
+
+	// The panicky bot survives to hear the roll, so both lines arrive in
+	// some order.
+	lines := []string{alice.read(t), alice.read(t), alice.read(t)}
+	assert.ElementsMatch(t, []string{
+		"[dicebot] alice rolled 3d1: 1 + 1 + 1 = 3",
+		"[panicky] heard !roll 3d1",
+		"[panicky] heard alice rolled 3d1: 1 + 1 + 1 = 3",
+	}, lines)
+}
+
+// blockingBot answers the first message it hears only once released, and
+// echoes the rest.
+type blockingBot struct {
+	say     func(string)
+	release chan struct{}
+}
+
+func (b *blockingBot) Name() Name { return "blocker" }
+
+func (b *blockingBot) Start(say func(string)) { b.say = say }
+
+func (b *blockingBot) HandleEvent(ev Event) {
+	if ev.Kind != EventMessage {
+		return
+	}
+	if b.release != nil {
+		<-b.release
+		b.release = nil
+	}
+	b.say("heard " + ev.Text)
+}
+
+func TestBlockingBot(t *testing.T) {
+	s := NewServer()
+	bot := &blockingBot{release: make(chan struct{})}
+	assert.Nil(t, s.AddBot(bot))
+	addr := startServer(t, s)
+	kicks := slowDisconnects.Value()
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	// Far more than fits in an inbox, while the bot is stuck on the first.
+	for i := 0; i < 50; i++ {
+		alice.send(t, fmt.Sprint(i))
+		bob.expect(t, fmt.Sprintf("[alice] %d", i))
+	}
+
+	close(bot.release)
+	for i := 0; i < 50; i++ {
+		bob.expect(t, fmt.Sprintf("[blocker] heard %d", i))
+	}
+	assert.Equal(t, kicks, slowDisconnects.Value())
+}
+
+func TestStuckBotIsKicked(t *testing.T) {
+	s := NewServer()
+	s.MaxQueuedBytes = 1024
+	bot := &blockingBot{release: make(chan struct{})}
+	assert.Nil(t, s.AddBot(bot))
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	// Bob keeps up, so only the bot falls behind.
+	var lines []string
+	for i := 0; i < 40; i++ {
+		alice.send(t, fmt.Sprint(i))
+		for {
+			line := bob.read(t)
+			lines = append(lines, line)
+			if line == fmt.Sprintf("[alice] %d", i) {
+				break
+			}
+		}
+	}
+	assert.Contains(t, lines, "* blocker has left the room")
+	assert.False(t, s.hasClient("blocker"))
+
+	// Once gone, the bot can no longer speak in the room.
+	close(bot.release)
+	time.Sleep(50 * time.Millisecond)
+	alice.send(t, "last")
+	bob.expect(t, "[alice] last")
+}
@@ -3,30 +3,98 @@ package budgetchat
 import (
 	"bufio"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
 	"regexp"
-	"strings"
 	"sync"
+	"time"
 )
 
+// slowDisconnects counts clients kicked for not keeping up with the room.
+var slowDisconnects = expvar.NewInt("budgetchat_slow_disconnects")
+
 type Name string
 
 type Server struct {
 	Clients    map[Name]*Client
 	ClientsMux sync.RWMutex
+
+	// History is replayed to new members when set. Leave nil to stick to the
+	// protocol spec.
+	History *History
+
+	// Transcript records joins, leaves and messages when set.
+	Transcript *Transcript
+
+	// Moderation enables slash commands, bans, mutes and the word filter.
+	Moderation *Moderation
+
+	// RateLimit throttles each client when set.
+	RateLimit *RateLimit
+
+	// MaxLineLength caps the length of a line read from a client. Longer lines
+	// disconnect the client. 0 uses bufio.MaxScanTokenSize.
+	MaxLineLength int
+
+	// Federation shares the room with other servers when set.
+	Federation *Federation
+
+	// Commands enables slash commands such as /who and /away. Moderation and
+	// Idle turn them on as well.
+	Commands bool
+
+	// Idle marks quiet users as away and eventually disconnects them when set.
+	Idle     *IdlePolicy
+	idleOnce sync.Once
+
+	// NamePolicy validates names. nil means SpecNamePolicy.
+	NamePolicy NamePolicy
+
+	// Registry lets users claim names with a password when set.
+	Registry *NameRegistry
+
+	// RosterOrder is RosterJoinOrder (the default) or RosterAlphabetical.
+	RosterOrder string
+
+	// RosterLineLength wraps the "room contains" line onto several lines once
+	// it would grow past this many bytes. 0 never wraps, as in the spec.
+	RosterLineLength int
+
+	// MaxQueuedBytes caps how much can wait to be sent to one client before
+	// it is disconnected for falling behind. 0 uses DefaultMaxQueuedBytes.
+	MaxQueuedBytes int
+
+	joinSeq uint64
 }
 
 type Client struct {
 	Name       Name
-	Inbox      chan string
+	Addr       string
+	Operator   bool
+	Inbox      chan Event
 	Outbox     chan string
 	Disconnect chan interface{}
+	Kicked     chan string
+
+	// Origin is the ID of the server a federated user is connected to, or
+	// empty for local users. Remote users have no inbox reader.
+	Origin string
+
+	limiter  *limiter
+	presence presence
+	joinSeq  uint64
+	queue    *eventQueue
 }
 
 var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
 
+var (
+	ErrInvalidName = errors.New("invalid name")
+	ErrNameInUse   = errors.New("name already used")
+)
+
 func NewServer() *Server {
 	return &Server{
 		Clients:    make(map[Name]*Client),
@@ -39,11 +107,16 @@ func (s *Server) Listen(addr string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Fatal("tcp server accept error", s.Serve(listener))
+}
 
+// Serve accepts chat clients on listener until accepting fails, and returns
+// the error.
+func (s *Server) Serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal("tcp server accept error", err)
+			return err
 		}
 
 		go s.handleConnection(conn)
@@ -53,6 +126,10 @@ func (s *Server) Listen(addr string) {
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	scanner := bufio.NewScanner(conn)
+	if s.MaxLineLength > 0 {
+		// The scanner's limit is the larger of max and cap(buf).
+		scanner.Buffer(nil, s.MaxLineLength)
+	}
 
 	_, err := conn.Write([]byte("Welcome to budgetchat! What shall I call you?\n"))
 	if err != nil {
@@ -67,108 +144,251 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
-	client := newClient(name)
-	s.broadcastAll(fmt.Sprintf("%s has entered the room", client.Name))
-	client.Inbox <- fmt.Sprintf("* The room contains: %s", strings.Join(s.listClientNames(), ", "))
+	addr := remoteIP(conn)
+	if s.Moderation != nil && s.Moderation.IsBanned(s.namePolicy().Key(name), addr) {
+		conn.Write([]byte("* You are banned\n"))
+		return
+	}
+
+	if s.nameClaimed(name) {
+		conn.Write([]byte(fmt.Sprintf("* %s is registered. Password?\n", name)))
+		if !scanner.Scan() || !s.checkNamePassword(name, scanner.Text()) {
+			conn.Write([]byte("* Wrong password\n"))
+			return
+		}
+	}
 
-	s.registerClient(&client)
+	client := s.newClient(name, addr)
+	client.presence.touch(time.Now())
+	names, history, err := s.join(client)
+	if err != nil {
+		return
+	}
+	defer s.leave(client)
 
-	defer s.broadcastAll(fmt.Sprintf("%s has left the room", client.Name))
-	defer s.disconnectClient(&client)
+	welcome := append(s.rosterLines(s.describeNames(names)), history...)
+	for _, msg := range welcome {
+		_, err := conn.Write([]byte(msg + "\n"))
+		if err != nil {
+			return
+		}
+	}
 
-	go client.readInputs(scanner)
+	done := make(chan interface{})
+	defer close(done)
+	go client.readInputs(scanner, done)
 
 	for {
 		select {
 		case <-client.Disconnect:
 			return
-		case msg := <-client.Inbox:
-			_, err := conn.Write([]byte(msg + "\n"))
+		case reason := <-client.Kicked:
+			conn.Write([]byte("* " + reason + "\n"))
+			return
+		case ev := <-client.Inbox:
+			_, err := conn.Write([]byte(ev.String() + "\n"))
 			if err != nil {
 				return
 			}
 		case msg := <-client.Outbox:
-			s.broadcast(&client, msg)
+			if reply := s.handleLine(client, msg); reply != "" {
+				_, err := conn.Write([]byte(reply + "\n"))
+				if err != nil {
+					return
+				}
+			}
 		}
 	}
 }
 
-func newClient(name Name) Client {
-	return Client{
+func (s *Server) newClient(name Name, addr string) *Client {
+	client := &Client{
 		Name:       name,
-		Inbox:      make(chan string, 10),
+		Addr:       addr,
+		Inbox:      make(chan Event, 10),
 		Outbox:     make(chan string, 1),
 		Disconnect: make(chan interface{}),
+		Kicked:     make(chan string, 1),
+		queue:      newEventQueue(),
 	}
+	if s.RateLimit != nil {
+		client.limiter = newLimiter(*s.RateLimit)
+	}
+	return client
 }
 
-func (s *Server) registerClient(client *Client) {
+// join announces client to the room and registers it, returning the names of
+// everyone who was already there and the history to replay to them. It all
+// happens under the write lock, so every member either sees the newcomer in
+// their roster or gets their join event, never both or neither, and every
+// message is either in the replayed history or delivered to the inbox.
+func (s *Server) join(client *Client) ([]string, []string, error) {
+	ev := Event{Kind: EventJoin, Sender: client.Name}
+
 	s.ClientsMux.Lock()
+	if s.nameTakenLocked(client.Name) {
+		s.ClientsMux.Unlock()
+		return nil, nil, ErrNameInUse
+	}
+
+	s.deliverLocked(ev, "")
+	s.record(ev)
+
+	names := s.listClientNamesLocked()
+	var history []string
+	if s.History != nil {
+		history = s.History.Replay()
+	}
+
+	s.joinSeq++
+	client.joinSeq = s.joinSeq
 	s.Clients[client.Name] = client
+	if client.Origin == "" {
+		go client.queue.run(client.Inbox)
+	}
 	s.ClientsMux.Unlock()
+
+	s.publish(client, ev)
+	s.startIdleSweeper()
+	return names, history, nil
 }
 
-func (s *Server) disconnectClient(client *Client) {
+// leave removes client from the room and announces it, if it was there.
+func (s *Server) leave(client *Client) {
+	ev := Event{Kind: EventLeave, Sender: client.Name}
+
 	s.ClientsMux.Lock()
+	if s.Clients[client.Name] != client {
+		s.ClientsMux.Unlock()
+		return
+	}
 	delete(s.Clients, client.Name)
+	client.queue.close()
+	s.deliverLocked(ev, "")
+	s.record(ev)
 	s.ClientsMux.Unlock()
+
+	s.publish(client, ev)
+}
+
+// publish relays events from local clients to federated servers.
+func (s *Server) publish(client *Client, ev Event) {
+	if s.Federation != nil && client.Origin == "" {
+		s.Federation.publish(ev)
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Kick asks the client's connection to close, without blocking if it is
+// already on its way out.
+func (c *Client) Kick(reason string) {
+	select {
+	case c.Kicked <- reason:
+	default:
+	}
 }
 
+// broadcast sends msg from sender to the room, unless sender has left it.
 func (s *Server) broadcast(sender *Client, msg string) {
+	ev := Event{Kind: EventMessage, Sender: sender.Name, Text: msg}
+
 	s.ClientsMux.RLock()
 	defer s.ClientsMux.RUnlock()
 
-	msg = fmt.Sprintf("[%s] %s", sender.Name, msg)
+	if s.Clients[sender.Name] != sender {
+		return
+	}
+	s.publish(sender, ev)
+
+	if s.History != nil {
+		s.History.Add(sender.Name, msg)
+	}
+	s.record(ev)
+	s.deliverLocked(ev, sender.Name)
+}
+
+// deliverLocked queues ev for every local client except skip. The caller must
+// hold s.ClientsMux, so it never waits on a recipient: anyone whose queue is
+// over its limits has fallen too far behind to catch up, and is kicked instead.
+func (s *Server) deliverLocked(ev Event, skip Name) {
+	maxBytes := s.MaxQueuedBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxQueuedBytes
+	}
 
+	now := time.Now()
 	for _, recipient := range s.Clients {
-		if recipient.Name == sender.Name {
+		if recipient.Name == skip || recipient.Origin != "" {
 			continue
 		}
-
-		recipient.Inbox <- msg
+		if !recipient.queue.push(ev, maxBytes, now) {
+			slowDisconnects.Add(1)
+			recipient.Kick("Disconnected for falling behind")
+		}
 	}
 }
 
-func (s *Server) broadcastAll(msg string) {
-	s.ClientsMux.RLock()
-	defer s.ClientsMux.RUnlock()
-
-	msg = fmt.Sprintf("* %s", msg)
-
-	for _, recipient := range s.Clients {
-		recipient.Inbox <- msg
+func (s *Server) record(ev Event) {
+	if s.Transcript == nil {
+		return
+	}
+	if err := s.Transcript.Write(Record{Event: ev}); err != nil {
+		log.Println("transcript:", err)
 	}
 }
 
 func (s *Server) listClientNames() []string {
 	s.ClientsMux.RLock()
 	defer s.ClientsMux.RUnlock()
-
-	names := make([]string, 0, len(s.Clients))
-	for _, client := range s.Clients {
-		names = append(names, string(client.Name))
-	}
-	return names
+	return s.listClientNamesLocked()
 }
 
-func (c *Client) readInputs(scanner *bufio.Scanner) {
+func (c *Client) readInputs(scanner *bufio.Scanner, done chan interface{}) {
+	defer close(c.Disconnect)
 	for scanner.Scan() {
-		c.Outbox <- scanner.Text()
+		select {
+		case c.Outbox <- scanner.Text():
+		case <-done:
+			return
+		}
 	}
-	close(c.Disconnect)
 }
 
-func (s *Server) validateName(name string) (Name, error) {
-	if !nameRegex.Match([]byte(name)) {
-		return "", errors.New("invalid name")
+func (s *Server) validateName(raw string) (Name, error) {
+	policy := s.namePolicy()
+	name, err := policy.Normalize(raw)
+	if err != nil {
+		return "", err
+	}
+	if s.nameTaken(name) {
+		return "", ErrNameInUse
 	}
+	return name, nil
+}
 
+// nameTaken reports whether anyone in the room already uses a name that the
+// name policy considers the same as name.
+func (s *Server) nameTaken(name Name) bool {
 	s.ClientsMux.RLock()
 	defer s.ClientsMux.RUnlock()
+	return s.nameTakenLocked(name)
+}
 
-	if _, ok := s.Clients[Name(name)]; ok {
-		return "", errors.New("name already used")
-	}
+func (s *Server) nameTakenLocked(name Name) bool {
+	policy := s.namePolicy()
+	key := policy.Key(name)
 
-	return Name(name), nil
+	for existing := range s.Clients {
+		if policy.Key(existing) == key {
+			return true
+		}
+	}
+	return false
 }
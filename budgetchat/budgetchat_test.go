@@ -0,0 +1,130 @@
+package budgetchat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func startServer(t *testing.T, s *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// join connects to addr as name and returns the client along with the roster
+// line it was greeted with.
+func join(t *testing.T, addr string, name Name) (*testClient, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, conn)
+	c.expect(t, "Welcome to budgetchat! What shall I call you?")
+	c.send(t, string(name))
+	return c, c.read(t)
+}
+
+func (c *testClient) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) read(t *testing.T) string {
+	t.Helper()
+	if !c.scanner.Scan() {
+		t.Fatalf("connection closed: %v", c.scanner.Err())
+	}
+	return c.scanner.Text()
+}
+
+func (c *testClient) expect(t *testing.T, line string) {
+	t.Helper()
+	assert.Equal(t, line, c.read(t))
+}
+
+func TestStuckClientIsKicked(t *testing.T) {
+	s := NewServer()
+	s.MaxQueuedBytes = 1024
+	stuck := s.newClient("stuck", "127.0.0.1")
+	_, _, err := s.join(stuck)
+	assert.Nil(t, err)
+	kicks := slowDisconnects.Value()
+
+	// Nobody reads stuck's inbox, so it fills up. Joins, leaves and messages
+	// must carry on regardless.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			other := s.newClient(Name(fmt.Sprintf("other%d", i)), "127.0.0.1")
+			s.join(other)
+			s.broadcast(other, "hi")
+			s.leave(other)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the room stalled on a stuck client")
+	}
+
+	assert.Equal(t, "Disconnected for falling behind", <-stuck.Kicked)
+	assert.Greater(t, slowDisconnects.Value(), kicks)
+}
+
+func TestConcurrentChatter(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	kicks := slowDisconnects.Value()
+
+	watcher, _ := join(t, addr, "watcher")
+	var talkers []*testClient
+	for i := 0; i < 20; i++ {
+		talker, _ := join(t, addr, Name(fmt.Sprintf("talker%d", i)))
+		watcher.read(t)
+		talkers = append(talkers, talker)
+	}
+
+	// Everyone talks at once, far more than fits in an inbox.
+	for _, talker := range talkers {
+		go func(talker *testClient) {
+			talker.conn.Write([]byte("one\ntwo\nthree\n"))
+		}(talker)
+	}
+	for i := 0; i < 3*len(talkers); i++ {
+		assert.Regexp(t, `^\[talker\d+\] (one|two|three)$`, watcher.read(t))
+	}
+	assert.Equal(t, kicks, slowDisconnects.Value())
+}
@@ -0,0 +1,225 @@
+package budgetchat
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultMuteDuration = 5 * time.Minute
+
+type command struct {
+	operatorOnly bool
+	run          func(s *Server, client *Client, args []string) string
+}
+
+var commands = map[string]command{
+	"/who":      {run: cmdWho},
+	"/away":     {run: cmdAway},
+	"/register": {run: cmdRegister},
+	"/oper":     {run: cmdOper},
+	"/kick":     {operatorOnly: true, run: cmdKick},
+	"/ban":      {operatorOnly: true, run: cmdBan},
+	"/banip":    {operatorOnly: true, run: cmdBanIP},
+	"/unban":    {operatorOnly: true, run: cmdUnban},
+	"/mute":     {operatorOnly: true, run: cmdMute},
+	"/unmute":   {operatorOnly: true, run: cmdUnmute},
+}
+
+// handleLine processes a line sent by client and returns a reply meant only
+// for that client, if any.
+func (s *Server) handleLine(client *Client, msg string) string {
+	client.presence.touch(time.Now())
+
+	if warning, ok := s.checkRate(client, msg); !ok {
+		return warning
+	}
+
+	if s.commandsEnabled() && strings.HasPrefix(msg, "/") {
+		return s.runCommand(client, msg)
+	}
+
+	msg, reply, ok := s.moderate(client, msg)
+	if !ok {
+		return reply
+	}
+
+	s.broadcast(client, msg)
+	return ""
+}
+
+// moderate applies bans, mutes and the word filter to a message from client.
+// It returns the message to broadcast, or a reply for client and false if the
+// message is dropped.
+func (s *Server) moderate(client *Client, msg string) (string, string, bool) {
+	// Other front ends end lines at any of these, so a message holding one
+	// could pass itself off as several, or as protocol lines.
+	if strings.ContainsAny(msg, "\r\n\x00") {
+		return "", "* Messages cannot contain line breaks or NUL characters", false
+	}
+
+	if s.Moderation == nil {
+		return msg, "", true
+	}
+
+	key := s.namePolicy().Key(client.Name)
+	if s.Moderation.IsBanned(key, client.Addr) {
+		return "", "* You are banned", false
+	}
+	if s.Moderation.IsMuted(key) {
+		return "", "* You are muted", false
+	}
+
+	msg, err := s.Moderation.Filter(msg)
+	if err != nil {
+		return "", fmt.Sprintf("* %s", err), false
+	}
+	return msg, "", true
+}
+
+// commandsEnabled reports whether lines starting with a slash are treated as
+// commands. The protocol spec has no commands, so they are off by default.
+func (s *Server) commandsEnabled() bool {
+	return s.Commands || s.Moderation != nil || s.Idle != nil || s.Registry != nil
+}
+
+func (s *Server) runCommand(client *Client, line string) string {
+	args := strings.Fields(line)
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Sprintf("* Unknown command %s", args[0])
+	}
+	if cmd.operatorOnly && !client.Operator {
+		return "* You are not an operator"
+	}
+	return cmd.run(s, client, args[1:])
+}
+
+// findClient returns the client whose name the name policy considers the same
+// as name, or nil if there is none.
+func (s *Server) findClient(name Name) *Client {
+	policy := s.namePolicy()
+	key := policy.Key(name)
+
+	s.ClientsMux.RLock()
+	defer s.ClientsMux.RUnlock()
+
+	for existing, client := range s.Clients {
+		if policy.Key(existing) == key {
+			return client
+		}
+	}
+	return nil
+}
+
+func cmdOper(s *Server, client *Client, args []string) string {
+	if s.Moderation == nil || len(args) != 1 || !s.Moderation.IsOperatorPassword(args[0]) {
+		return "* Wrong operator password"
+	}
+	client.Operator = true
+	return "* You are now an operator"
+}
+
+func cmdKick(s *Server, client *Client, args []string) string {
+	if len(args) != 1 {
+		return "* Usage: /kick <name>"
+	}
+	target := s.findClient(Name(args[0]))
+	if target == nil {
+		return fmt.Sprintf("* No such user %s", args[0])
+	}
+	if target.Origin != "" {
+		return fmt.Sprintf("* %s is connected to %s and cannot be kicked from here", target.Name, target.Origin)
+	}
+	target.Kick(fmt.Sprintf("You were kicked by %s", client.Name))
+	return fmt.Sprintf("* Kicked %s", target.Name)
+}
+
+func cmdBan(s *Server, client *Client, args []string) string {
+	if len(args) != 1 {
+		return "* Usage: /ban <name>"
+	}
+	name := Name(args[0])
+	if err := s.Moderation.BanName(s.namePolicy().Key(name)); err != nil {
+		return fmt.Sprintf("* Could not save ban: %s", err)
+	}
+	if target := s.findClient(name); target != nil {
+		target.Kick(fmt.Sprintf("You were banned by %s", client.Name))
+	}
+	return fmt.Sprintf("* Banned %s", name)
+}
+
+// cmdBanIP accepts either a connected user's name or a literal IP address.
+func cmdBanIP(s *Server, client *Client, args []string) string {
+	if len(args) != 1 {
+		return "* Usage: /banip <name|ip>"
+	}
+
+	ip := args[0]
+	if target := s.findClient(Name(args[0])); target != nil {
+		if target.Origin != "" {
+			return fmt.Sprintf("* %s is connected to %s and cannot be banned by IP from here", target.Name, target.Origin)
+		}
+		if target.Addr == botAddr {
+			return fmt.Sprintf("* %s is a bot and has no IP to ban", target.Name)
+		}
+		ip = target.Addr
+	} else if net.ParseIP(ip) == nil {
+		return fmt.Sprintf("* No such user or IP %s", args[0])
+	}
+
+	if err := s.Moderation.BanIP(ip); err != nil {
+		return fmt.Sprintf("* Could not save ban: %s", err)
+	}
+
+	s.ClientsMux.RLock()
+	for _, target := range s.Clients {
+		if target.Addr == ip {
+			target.Kick(fmt.Sprintf("You were banned by %s", client.Name))
+		}
+	}
+	s.ClientsMux.RUnlock()
+
+	return fmt.Sprintf("* Banned %s", ip)
+}
+
+func cmdUnban(s *Server, client *Client, args []string) string {
+	if len(args) != 1 {
+		return "* Usage: /unban <name|ip>"
+	}
+	found, err := s.Moderation.Unban(s.namePolicy().Key(Name(args[0])), args[0])
+	if err != nil {
+		return fmt.Sprintf("* Could not save ban: %s", err)
+	}
+	if !found {
+		return fmt.Sprintf("* %s is not banned", args[0])
+	}
+	return fmt.Sprintf("* Unbanned %s", args[0])
+}
+
+func cmdMute(s *Server, client *Client, args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "* Usage: /mute <name> [duration]"
+	}
+
+	d := defaultMuteDuration
+	if len(args) == 2 {
+		var err error
+		d, err = time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return fmt.Sprintf("* Invalid duration %s", args[1])
+		}
+	}
+
+	s.Moderation.Mute(s.namePolicy().Key(Name(args[0])), d)
+	return fmt.Sprintf("* Muted %s for %s", args[0], d)
+}
+
+func cmdUnmute(s *Server, client *Client, args []string) string {
+	if len(args) != 1 {
+		return "* Usage: /unmute <name>"
+	}
+	s.Moderation.Unmute(s.namePolicy().Key(Name(args[0])))
+	return fmt.Sprintf("* Unmuted %s", args[0])
+}
@@ -0,0 +1,28 @@
+package budgetchat
+
+import "fmt"
+
+const (
+	EventJoin    = "join"
+	EventLeave   = "leave"
+	EventMessage = "message"
+)
+
+// Event is something that happened in the room. Front-ends render events in
+// their own protocol; String gives the native budgetchat line.
+type Event struct {
+	Kind   string `json:"event"`
+	Sender Name   `json:"sender"`
+	Text   string `json:"text,omitempty"`
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case EventJoin:
+		return fmt.Sprintf("* %s has entered the room", e.Sender)
+	case EventLeave:
+		return fmt.Sprintf("* %s has left the room", e.Sender)
+	default:
+		return fmt.Sprintf("[%s] %s", e.Sender, e.Text)
+	}
+}
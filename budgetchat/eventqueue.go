@@ -0,0 +1,103 @@
+package budgetchat
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxQueuedBytes is how much can wait to be sent to one client
+	// when Server.MaxQueuedBytes is 0.
+	DefaultMaxQueuedBytes = 1 << 20
+	// maxQueueAge is how long an event can wait to be sent to a client before
+	// the client is considered stuck.
+	maxQueueAge = 30 * time.Second
+	// eventOverhead approximates what an event costs beyond its text.
+	eventOverhead = 64
+)
+
+type queuedEvent struct {
+	ev Event
+	at time.Time
+}
+
+// eventQueue holds events on their way to a client's Inbox, so that the room
+// never waits on a client while delivering. A client is only in trouble once
+// its queue holds too many bytes, or an event has been waiting too long; a
+// burst of joins or chatter is just queued.
+type eventQueue struct {
+	events []queuedEvent
+	bytes  int
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{wake: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// push queues ev, reporting false if the queue is over its limits, in which
+// case ev is dropped.
+func (q *eventQueue) push(ev Event, maxBytes int, now time.Time) bool {
+	size := len(ev.Sender) + len(ev.Text) + eventOverhead
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return true
+	}
+	if q.bytes+size > maxBytes || (len(q.events) > 0 && now.Sub(q.events[0].at) > maxQueueAge) {
+		return false
+	}
+	q.events = append(q.events, queuedEvent{ev: ev, at: now})
+	q.bytes += size
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run moves queued events into inbox until the queue is closed.
+func (q *eventQueue) run(inbox chan<- Event) {
+	for {
+		q.mu.Lock()
+		if len(q.events) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		next := q.events[0]
+		q.events[0] = queuedEvent{}
+		q.events = q.events[1:]
+		q.bytes -= len(next.ev.Sender) + len(next.ev.Text) + eventOverhead
+		q.mu.Unlock()
+
+		select {
+		case inbox <- next.ev:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// close drops whatever is queued and stops run.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		q.events = nil
+		q.bytes = 0
+		close(q.done)
+	}
+}
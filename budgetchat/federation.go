@@ -0,0 +1,427 @@
+package budgetchat
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	linkChallenge = "challenge"
+	linkHello     = "hello"
+	linkUsers     = "users"
+	linkEvent     = "event"
+)
+
+// linkHandshakeTimeout bounds how long a peer has to authenticate and send its
+// user list.
+const linkHandshakeTimeout = 10 * time.Second
+
+const linkQueueSize = 256
+
+// linkMessage is one JSON line on a server-to-server link. Each side opens with
+// a challenge holding a random nonce, then a hello proving it knows the shared
+// secret. Only once the other side's proof checks out does each send the list
+// of every user it knows about, and then stream room events.
+// Events carry the server the user is connected to (the origin) so they can be
+// relayed onwards without echoing back.
+type linkMessage struct {
+	Type   string       `json:"type"`
+	Nonce  string       `json:"nonce,omitempty"`
+	Server string       `json:"server,omitempty"`
+	Proof  string       `json:"proof,omitempty"`
+	Users  []remoteUser `json:"users,omitempty"`
+	Origin string       `json:"origin,omitempty"`
+	Event  *Event       `json:"event,omitempty"`
+}
+
+type remoteUser struct {
+	Origin string `json:"origin"`
+	Name   Name   `json:"name"`
+}
+
+type peerLink struct {
+	server string
+	conn   net.Conn
+	out    chan linkMessage
+	once   sync.Once
+}
+
+type remoteClient struct {
+	client *Client
+	via    *peerLink
+}
+
+// Federation links budgetchat servers into one shared room. Links must form a
+// tree: every pair of servers is joined by exactly one path, so each server
+// should be listed as a peer on only one side of a link.
+//
+// Users on other servers show up in the roster under their own name, or as
+// name@server if that name is already taken here. When a link drops, everyone
+// reached through it leaves the room; they come back once it reconnects.
+//
+// Messages from other servers go through the same rate limits, mutes, bans and
+// word filter as local ones before they are shown or relayed.
+type Federation struct {
+	ServerID string
+	// Secret is shared by every server in the federation. Links from servers
+	// that cannot prove they know it are refused.
+	Secret        string
+	RetryInterval time.Duration
+	MaxRetry      time.Duration
+
+	s       *Server
+	links   map[*peerLink]bool
+	remotes map[remoteUser]*remoteClient
+	mu      sync.Mutex
+}
+
+var (
+	errDuplicateLink = errors.New("already linked")
+	errBadProof      = errors.New("wrong link secret")
+	errBadHandshake  = errors.New("bad handshake")
+)
+
+// Federate enables linking s with other servers under the given server ID,
+// using secret to authenticate links.
+func (s *Server) Federate(serverID, secret string) *Federation {
+	s.Federation = &Federation{
+		ServerID:      serverID,
+		Secret:        secret,
+		RetryInterval: time.Second,
+		MaxRetry:      30 * time.Second,
+		s:             s,
+		links:         make(map[*peerLink]bool),
+		remotes:       make(map[remoteUser]*remoteClient),
+	}
+	return s.Federation
+}
+
+func (f *Federation) Listen(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f.serve(listener)
+}
+
+func (f *Federation) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("federation accept error", err)
+			return
+		}
+
+		go f.handleLink(conn)
+	}
+}
+
+// Connect keeps a link to the peer at addr open for as long as the process
+// runs, redialing with exponential backoff whenever it drops.
+func (f *Federation) Connect(addr string) {
+	delay := f.RetryInterval
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Printf("federation: dial %s: %v", addr, err)
+		} else {
+			start := time.Now()
+			f.handleLink(conn)
+			if time.Since(start) > f.MaxRetry {
+				delay = f.RetryInterval
+			}
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > f.MaxRetry {
+			delay = f.MaxRetry
+		}
+	}
+}
+
+func (f *Federation) handleLink(conn net.Conn) {
+	defer conn.Close()
+
+	if f.Secret == "" {
+		log.Println("federation: refusing link, no secret set")
+		return
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+
+	conn.SetDeadline(time.Now().Add(linkHandshakeTimeout))
+	server, err := f.handshake(encoder, decoder)
+	if err != nil {
+		log.Printf("federation: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Start queueing events before taking the roster snapshot so that nothing
+	// happening in between is lost. Duplicates are harmless.
+	link := &peerLink{server: server, conn: conn, out: make(chan linkMessage, linkQueueSize)}
+	if err := f.addLink(link); err != nil {
+		log.Printf("federation: %s: %v", server, err)
+		return
+	}
+	defer f.removeLink(link)
+
+	if err := encoder.Encode(linkMessage{Type: linkUsers, Users: f.knownUsers()}); err != nil {
+		log.Println("federation:", err)
+		return
+	}
+	var users linkMessage
+	if err := decoder.Decode(&users); err != nil || users.Type != linkUsers {
+		log.Printf("federation: %s: bad user list", server)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("federation: linked with %s", server)
+
+	go func() {
+		for msg := range link.out {
+			if err := encoder.Encode(msg); err != nil {
+				link.close()
+				return
+			}
+		}
+	}()
+
+	for _, user := range users.Users {
+		f.applyJoin(link, user)
+	}
+
+	for {
+		var msg linkMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Type != linkEvent || msg.Event == nil || msg.Origin == f.ServerID {
+			continue
+		}
+
+		user := remoteUser{Origin: msg.Origin, Name: msg.Event.Sender}
+		switch msg.Event.Kind {
+		case EventJoin:
+			f.applyJoin(link, user)
+		case EventLeave:
+			f.applyLeave(link, user)
+		case EventMessage:
+			f.applyMessage(link, user, msg.Event.Text)
+		}
+	}
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// proof shows that the server with the given ID knows the secret, in answer to
+// a nonce. Including the ID stops a proof being reflected back to its sender.
+func (f *Federation) proof(nonce, server string) string {
+	mac := hmac.New(sha256.New, []byte(f.Secret))
+	mac.Write([]byte(nonce + "\n" + server))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handshake exchanges challenges and hellos with a peer, returning its server
+// ID once it has proved it knows the secret.
+func (f *Federation) handshake(encoder *json.Encoder, decoder *json.Decoder) (string, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+	if err := encoder.Encode(linkMessage{Type: linkChallenge, Nonce: nonce}); err != nil {
+		return "", err
+	}
+
+	var challenge linkMessage
+	if err := decoder.Decode(&challenge); err != nil {
+		return "", err
+	}
+	if challenge.Type != linkChallenge || challenge.Nonce == "" {
+		return "", errBadHandshake
+	}
+
+	proof := f.proof(challenge.Nonce, f.ServerID)
+	if err := encoder.Encode(linkMessage{Type: linkHello, Server: f.ServerID, Proof: proof}); err != nil {
+		return "", err
+	}
+
+	var hello linkMessage
+	if err := decoder.Decode(&hello); err != nil {
+		return "", err
+	}
+	if hello.Type != linkHello || hello.Server == "" || hello.Server == f.ServerID {
+		return "", errBadHandshake
+	}
+	if !hmac.Equal([]byte(hello.Proof), []byte(f.proof(nonce, hello.Server))) {
+		return "", errBadProof
+	}
+	return hello.Server, nil
+}
+
+func (l *peerLink) close() {
+	l.once.Do(func() {
+		l.conn.Close()
+	})
+}
+
+// knownUsers lists local users and everyone reachable through other links.
+func (f *Federation) knownUsers() []remoteUser {
+	f.s.ClientsMux.RLock()
+	users := make([]remoteUser, 0, len(f.s.Clients))
+	for _, client := range f.s.Clients {
+		if client.Origin == "" {
+			users = append(users, remoteUser{Origin: f.ServerID, Name: client.Name})
+		}
+	}
+	f.s.ClientsMux.RUnlock()
+
+	f.mu.Lock()
+	for user := range f.remotes {
+		users = append(users, user)
+	}
+	f.mu.Unlock()
+
+	return users
+}
+
+func (f *Federation) addLink(link *peerLink) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for other := range f.links {
+		if other.server == link.server {
+			return errDuplicateLink
+		}
+	}
+	f.links[link] = true
+	return nil
+}
+
+func (f *Federation) removeLink(link *peerLink) {
+	link.close()
+
+	f.mu.Lock()
+	delete(f.links, link)
+	close(link.out)
+	gone := make([]remoteUser, 0)
+	for user, remote := range f.remotes {
+		if remote.via == link {
+			gone = append(gone, user)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, user := range gone {
+		f.applyLeave(link, user)
+	}
+	if link.server != "" {
+		log.Printf("federation: lost link with %s", link.server)
+	}
+}
+
+// send queues msg on every link except one. A link that cannot keep up is
+// dropped and will resync its roster when it reconnects.
+func (f *Federation) send(msg linkMessage, except *peerLink) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for link := range f.links {
+		if link == except {
+			continue
+		}
+		select {
+		case link.out <- msg:
+		default:
+			log.Printf("federation: %s is too slow, dropping link", link.conn.RemoteAddr())
+			link.close()
+		}
+	}
+}
+
+// publish relays an event from a local client to every peer.
+func (f *Federation) publish(ev Event) {
+	f.send(linkMessage{Type: linkEvent, Origin: f.ServerID, Event: &ev}, nil)
+}
+
+func (f *Federation) applyJoin(link *peerLink, user remoteUser) {
+	if user.Origin == f.ServerID {
+		return
+	}
+
+	f.mu.Lock()
+	_, known := f.remotes[user]
+	f.mu.Unlock()
+	if known {
+		return
+	}
+
+	// Events for a user only arrive over one link, so nobody else can add
+	// them between the check above and the insert below.
+	client := f.s.newClient(user.Name, user.Origin)
+	client.Origin = user.Origin
+	if _, _, err := f.s.join(client); err != nil {
+		client.Name = Name(fmt.Sprintf("%s@%s", user.Name, user.Origin))
+		if _, _, err := f.s.join(client); err != nil {
+			log.Printf("federation: cannot add %s: %v", client.Name, err)
+			return
+		}
+	}
+
+	f.mu.Lock()
+	f.remotes[user] = &remoteClient{client: client, via: link}
+	f.mu.Unlock()
+
+	f.send(linkMessage{Type: linkEvent, Origin: user.Origin, Event: &Event{Kind: EventJoin, Sender: user.Name}}, link)
+}
+
+func (f *Federation) applyLeave(link *peerLink, user remoteUser) {
+	f.mu.Lock()
+	remote, ok := f.remotes[user]
+	if !ok || remote.via != link {
+		f.mu.Unlock()
+		return
+	}
+	delete(f.remotes, user)
+	f.mu.Unlock()
+
+	f.s.leave(remote.client)
+	f.send(linkMessage{Type: linkEvent, Origin: user.Origin, Event: &Event{Kind: EventLeave, Sender: user.Name}}, link)
+}
+
+func (f *Federation) applyMessage(link *peerLink, user remoteUser, text string) {
+	f.mu.Lock()
+	remote, ok := f.remotes[user]
+	f.mu.Unlock()
+	if !ok || remote.via != link {
+		return
+	}
+
+	if _, ok := f.s.checkRate(remote.client, text); !ok {
+		return
+	}
+	text, _, ok = f.s.moderate(remote.client, text)
+	if !ok {
+		return
+	}
+
+	f.s.broadcast(remote.client, text)
+	f.send(linkMessage{Type: linkEvent, Origin: user.Origin, Event: &Event{Kind: EventMessage, Sender: user.Name, Text: text}}, link)
+}
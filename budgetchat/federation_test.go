@@ -0,0 +1,187 @@
+package budgetchat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startFederatedServer(t *testing.T, id string) (*Server, string, string) {
+	s := NewServer()
+	f := s.Federate(id, "hunter2")
+	f.RetryInterval = 10 * time.Millisecond
+	f.MaxRetry = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve(listener)
+
+	return s, startServer(t, s), listener.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) hasClient(name Name) bool {
+	return s.findClient(name) != nil
+}
+
+func (f *Federation) linkCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.links)
+}
+
+func (f *Federation) dropLinks() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for link := range f.links {
+		link.close()
+	}
+}
+
+func TestFederationChain(t *testing.T) {
+	a, aAddr, aLink := startFederatedServer(t, "a")
+	b, _, bLink := startFederatedServer(t, "b")
+	c, cAddr, _ := startFederatedServer(t, "c")
+
+	go b.Federation.Connect(aLink)
+	go c.Federation.Connect(bLink)
+	waitFor(t, "links", func() bool { return b.Federation.linkCount() == 2 })
+
+	alice, _ := join(t, aAddr, "alice")
+	waitFor(t, "alice to reach c", func() bool { return c.hasClient("alice") })
+
+	bob, roster := join(t, cAddr, "bob")
+	assert.Equal(t, "* The room contains: alice", roster)
+	alice.expect(t, "* bob has entered the room")
+
+	bob.send(t, "hi from c")
+	alice.expect(t, "[bob] hi from c")
+	alice.send(t, "hi from a")
+	bob.expect(t, "[alice] hi from a")
+
+	// Dropping b's links makes bob leave a; the links come back on their own.
+	b.Federation.dropLinks()
+	alice.expect(t, "* bob has left the room")
+	alice.expect(t, "* bob has entered the room")
+	bob.expect(t, "* alice has left the room")
+	bob.expect(t, "* alice has entered the room")
+
+	bob.send(t, "still here")
+	alice.expect(t, "[bob] still here")
+	assert.True(t, a.hasClient("bob"))
+}
+
+func TestFederationNameCollision(t *testing.T) {
+	a, aAddr, aLink := startFederatedServer(t, "a")
+	b, bAddr, _ := startFederatedServer(t, "b")
+
+	aliceA, _ := join(t, aAddr, "alice")
+	aliceB, _ := join(t, bAddr, "alice")
+
+	go b.Federation.Connect(aLink)
+	aliceA.expect(t, "* alice@b has entered the room")
+	aliceB.expect(t, "* alice@a has entered the room")
+
+	aliceB.send(t, "which one am I")
+	aliceA.expect(t, "[alice@b] which one am I")
+
+	names := strings.Join(a.listClientNames(), " ")
+	assert.Contains(t, names, "alice@b")
+	assert.Equal(t, 1, a.Federation.linkCount())
+}
+
+func TestFederationNeedsSecret(t *testing.T) {
+	a, aAddr, aLink := startFederatedServer(t, "a")
+	b, _, _ := startFederatedServer(t, "b")
+	b.Federation.Secret = "wrong"
+
+	go b.Federation.Connect(aLink)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, a.Federation.linkCount())
+	assert.Equal(t, 0, b.Federation.linkCount())
+
+	// A stranger never sees the roster, and is never treated as a link.
+	join(t, aAddr, "alice")
+	conn, err := net.Dial("tcp", aLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	assert.Nil(t, encoder.Encode(linkMessage{Type: linkChallenge, Nonce: "nonce"}))
+	assert.Nil(t, encoder.Encode(linkMessage{Type: linkHello, Server: "mallory", Proof: "guess"}))
+
+	var types []string
+	for {
+		var msg linkMessage
+		if err := decoder.Decode(&msg); err != nil {
+			break
+		}
+		assert.Empty(t, msg.Users)
+		types = append(types, msg.Type)
+	}
+	assert.Equal(t, []string{linkChallenge, linkHello}, types)
+	assert.Equal(t, 0, a.Federation.linkCount())
+}
+
+func TestFederationModeratesRemoteMessages(t *testing.T) {
+	a, aAddr, aLink := startFederatedServer(t, "a")
+	b, bAddr, _ := startFederatedServer(t, "b")
+	moderation, err := NewModeration("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, moderation.SetFilter([]string{"darn"}, FilterRedact))
+	moderation.Mute("bob", time.Minute)
+	a.Moderation = moderation
+
+	go b.Federation.Connect(aLink)
+	waitFor(t, "link", func() bool { return a.Federation.linkCount() == 1 })
+	alice, _ := join(t, aAddr, "alice")
+	bob, _ := join(t, bAddr, "bob")
+	carol, _ := join(t, bAddr, "carol")
+	waitFor(t, "bob and carol to reach a", func() bool { return a.hasClient("bob") && a.hasClient("carol") })
+	alice.expect(t, "* bob has entered the room")
+	alice.expect(t, "* carol has entered the room")
+
+	bob.send(t, "nobody hears this")
+	carol.send(t, "darn it")
+	alice.expect(t, "[carol] **** it")
+}
+
+func TestFederationLargeRoster(t *testing.T) {
+	a, aAddr, aLink := startFederatedServer(t, "a")
+	b, bAddr, _ := startFederatedServer(t, "b")
+	kicks := slowDisconnects.Value()
+
+	alice, _ := join(t, aAddr, "alice")
+	for i := 0; i < 40; i++ {
+		join(t, bAddr, Name(fmt.Sprintf("user%d", i)))
+	}
+
+	// Linking merges b's whole roster into a's room in one burst.
+	go b.Federation.Connect(aLink)
+	for i := 0; i < 40; i++ {
+		assert.Regexp(t, `^\* user\d+ has entered the room$`, alice.read(t))
+	}
+	alice.send(t, "welcome")
+	waitFor(t, "everyone on a", func() bool { return len(a.listClientNames()) == 41 })
+	assert.Equal(t, kicks, slowDisconnects.Value())
+}
@@ -0,0 +1,92 @@
+package budgetchat
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type historyEntry struct {
+	Time   time.Time
+	Sender Name
+	Text   string
+}
+
+// History is a bounded ring buffer of recent room messages that gets replayed
+// to new members. Entries older than MaxAge are skipped (0 means no limit).
+type History struct {
+	MaxAge time.Duration
+
+	entries []historyEntry
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+func NewHistory(size int, maxAge time.Duration) *History {
+	return &History{
+		MaxAge:  maxAge,
+		entries: make([]historyEntry, size),
+	}
+}
+
+func (h *History) Add(sender Name, text string) {
+	h.add(historyEntry{Time: time.Now(), Sender: sender, Text: text})
+}
+
+func (h *History) add(entry historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *History) recent(now time.Time) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var ordered []historyEntry
+	if h.full {
+		ordered = append(ordered, h.entries[h.next:]...)
+	}
+	ordered = append(ordered, h.entries[:h.next]...)
+
+	recent := make([]historyEntry, 0, len(ordered))
+	for _, entry := range ordered {
+		if h.MaxAge > 0 && now.Sub(entry.Time) > h.MaxAge {
+			continue
+		}
+		recent = append(recent, entry)
+	}
+	return recent
+}
+
+// Replay returns the lines sent to a newly joined client, oldest first.
+func (h *History) Replay() []string {
+	recent := h.recent(time.Now())
+
+	lines := make([]string, 0, len(recent))
+	for _, entry := range recent {
+		lines = append(lines, fmt.Sprintf("* (history %s) [%s] %s", entry.Time.Format("15:04:05"), entry.Sender, entry.Text))
+	}
+	return lines
+}
+
+// LoadTranscript seeds the history with the messages recorded in a transcript.
+func (h *History) LoadTranscript(r io.Reader) error {
+	return ReadTranscript(r, func(rec Record) error {
+		if rec.Kind == EventMessage {
+			h.add(historyEntry{Time: rec.Time, Sender: rec.Sender, Text: rec.Text})
+		}
+		return nil
+	})
+}
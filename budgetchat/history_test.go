@@ -0,0 +1,31 @@
+package budgetchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryWrapsAround(t *testing.T) {
+	h := NewHistory(3, 0)
+	for _, text := range []string{"one", "two", "three", "four"} {
+		h.Add("alice", text)
+	}
+
+	texts := make([]string, 0)
+	for _, entry := range h.recent(time.Now()) {
+		texts = append(texts, entry.Text)
+	}
+	assert.Equal(t, []string{"two", "three", "four"}, texts)
+}
+
+func TestHistorySkipsOldEntries(t *testing.T) {
+	h := NewHistory(3, time.Minute)
+	h.add(historyEntry{Time: time.Now().Add(-time.Hour), Sender: "alice", Text: "stale"})
+	h.Add("bob", "fresh")
+
+	recent := h.recent(time.Now())
+	assert.Len(t, recent, 1)
+	assert.Equal(t, Name("bob"), recent[0].Sender)
+}
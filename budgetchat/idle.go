@@ -0,0 +1,156 @@
+package budgetchat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdlePolicy marks users as away after AwayAfter without sending a line, and
+// disconnects them after DisconnectAfter. Either may be 0 to disable it.
+type IdlePolicy struct {
+	AwayAfter       time.Duration
+	DisconnectAfter time.Duration
+}
+
+// presence is shared between a client's own goroutine and everyone running
+// /who or building a roster, so it has its own lock.
+type presence struct {
+	lastActive time.Time
+	away       bool
+	autoAway   bool
+	reason     string
+	mu         sync.Mutex
+}
+
+func (p *presence) touch(now time.Time) {
+	p.mu.Lock()
+	p.lastActive = now
+	if p.autoAway {
+		p.away = false
+		p.autoAway = false
+		p.reason = ""
+	}
+	p.mu.Unlock()
+}
+
+func (p *presence) setAway(reason string) {
+	p.mu.Lock()
+	p.away = reason != ""
+	p.autoAway = false
+	p.reason = reason
+	p.mu.Unlock()
+}
+
+// status describes the client for /who and the roster, or returns "" if they
+// are here.
+func (p *presence) status(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.away {
+		return ""
+	}
+	if p.autoAway {
+		return fmt.Sprintf("away: idle %s", now.Sub(p.lastActive).Truncate(time.Second))
+	}
+	return fmt.Sprintf("away: %s", p.reason)
+}
+
+// sweep applies the policy to p and reports whether it should be disconnected.
+func (p *presence) sweep(policy IdlePolicy, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastActive.IsZero() {
+		return false
+	}
+
+	idle := now.Sub(p.lastActive)
+	if policy.DisconnectAfter > 0 && idle >= policy.DisconnectAfter {
+		return true
+	}
+	if policy.AwayAfter > 0 && idle >= policy.AwayAfter && !p.away {
+		p.away = true
+		p.autoAway = true
+	}
+	return false
+}
+
+func (s *Server) startIdleSweeper() {
+	if s.Idle == nil {
+		return
+	}
+	s.idleOnce.Do(func() {
+		go s.sweepIdle()
+	})
+}
+
+// Sweeps run at a quarter of the shortest timeout, within these bounds.
+const (
+	minIdleSweep = 10 * time.Millisecond
+	maxIdleSweep = 30 * time.Second
+)
+
+func (s *Server) sweepIdle() {
+	if s.Idle.AwayAfter <= 0 && s.Idle.DisconnectAfter <= 0 {
+		return
+	}
+
+	interval := s.Idle.AwayAfter
+	if interval <= 0 || (s.Idle.DisconnectAfter > 0 && s.Idle.DisconnectAfter < interval) {
+		interval = s.Idle.DisconnectAfter
+	}
+	interval /= 4
+	if interval < minIdleSweep {
+		interval = minIdleSweep
+	}
+	if interval > maxIdleSweep {
+		interval = maxIdleSweep
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.ClientsMux.RLock()
+		for _, client := range s.Clients {
+			if client.presence.sweep(*s.Idle, now) {
+				client.Kick("Disconnected for being idle")
+			}
+		}
+		s.ClientsMux.RUnlock()
+	}
+}
+
+func cmdAway(s *Server, client *Client, args []string) string {
+	client.presence.setAway(strings.Join(args, " "))
+	if len(args) == 0 {
+		return "* You are no longer marked as away"
+	}
+	return "* You are now marked as away"
+}
+
+func cmdWho(s *Server, client *Client, args []string) string {
+	return fmt.Sprintf("* Online: %s", strings.Join(s.describeNames(s.listClientNames()), ", "))
+}
+
+// describeNames annotates the names of users who are away with their status.
+func (s *Server) describeNames(names []string) []string {
+	now := time.Now()
+	described := make([]string, len(names))
+
+	s.ClientsMux.RLock()
+	defer s.ClientsMux.RUnlock()
+
+	for i, name := range names {
+		described[i] = name
+		if client, ok := s.Clients[Name(name)]; ok {
+			if status := client.presence.status(now); status != "" {
+				described[i] = fmt.Sprintf("%s (%s)", name, status)
+			}
+		}
+	}
+	return described
+}
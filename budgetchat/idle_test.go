@@ -0,0 +1,66 @@
+package budgetchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceSweep(t *testing.T) {
+	policy := IdlePolicy{AwayAfter: time.Minute, DisconnectAfter: time.Hour}
+	start := time.Now()
+
+	var p presence
+	assert.False(t, p.sweep(policy, start.Add(2*time.Hour)), "never active, e.g. a bot")
+
+	p.touch(start)
+	assert.False(t, p.sweep(policy, start.Add(30*time.Second)))
+	assert.Equal(t, "", p.status(start.Add(30*time.Second)))
+
+	assert.False(t, p.sweep(policy, start.Add(2*time.Minute)))
+	assert.Equal(t, "away: idle 3m0s", p.status(start.Add(3*time.Minute)))
+
+	p.touch(start.Add(4 * time.Minute))
+	assert.Equal(t, "", p.status(start.Add(4*time.Minute)))
+
+	p.setAway("lunch")
+	p.touch(start.Add(5 * time.Minute))
+	assert.Equal(t, "away: lunch", p.status(start.Add(5*time.Minute)), "manual away survives activity")
+
+	assert.True(t, p.sweep(policy, start.Add(2*time.Hour)))
+}
+
+func TestIdleDisconnect(t *testing.T) {
+	s := NewServer()
+	s.Idle = &IdlePolicy{AwayAfter: 50 * time.Millisecond, DisconnectAfter: 200 * time.Millisecond}
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	bob.send(t, "/away brb")
+	bob.expect(t, "* You are now marked as away")
+
+	time.Sleep(100 * time.Millisecond)
+	alice.send(t, "/who")
+	alice.expect(t, "* Online: alice, bob (away: brb)")
+
+	bob.expect(t, "* Disconnected for being idle")
+	alice.expect(t, "* bob has left the room")
+}
+
+func TestIdleSweepTinyPolicy(t *testing.T) {
+	for _, policy := range []IdlePolicy{{}, {AwayAfter: 3 * time.Nanosecond}} {
+		s := NewServer()
+		policy := policy
+		s.Idle = &policy
+		addr := startServer(t, s)
+
+		alice, _ := join(t, addr, "alice")
+		time.Sleep(50 * time.Millisecond)
+		alice.send(t, "/who")
+		assert.Contains(t, alice.read(t), "* Online: alice")
+	}
+}
@@ -0,0 +1,427 @@
+package budgetchat
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	ircServerName = "budgetchat"
+	ircChannel    = "#budgetchat"
+)
+
+// Numeric replies from RFC 1459 that common clients need to register, join
+// and list names.
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplCreated          = "003"
+	rplMyInfo           = "004"
+	rplEndOfWho         = "315"
+	rplChannelModeIs    = "324"
+	rplNoTopic          = "331"
+	rplWhoReply         = "352"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errNoRecipient      = "411"
+	errNoTextToSend     = "412"
+	errUnknownCommand   = "421"
+	errNoMotd           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNickname = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+	errYoureBannedCreep = "465"
+)
+
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+func parseIRCMessage(line string) ircMessage {
+	var msg ircMessage
+
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		prefix, rest, _ := strings.Cut(line[1:], " ")
+		msg.Prefix = prefix
+		line = rest
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param == "" {
+			continue
+		}
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(param)
+		} else {
+			msg.Params = append(msg.Params, param)
+		}
+	}
+
+	return msg
+}
+
+type ircSession struct {
+	s      *Server
+	conn   net.Conn
+	addr   string
+	nick   string
+	user   string
+	pass   string
+	client *Client
+	joined bool
+}
+
+func (s *Server) ListenIRC(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal("tcp server accept error", err)
+		}
+
+		go s.handleIRCConnection(conn)
+	}
+}
+
+func (s *Server) handleIRCConnection(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &ircSession{s: s, conn: conn, addr: remoteIP(conn)}
+
+	done := make(chan interface{})
+	defer close(done)
+	lines := readIRCLines(conn, s.MaxLineLength, done)
+
+	for sess.client == nil {
+		line, ok := <-lines
+		if !ok {
+			return
+		}
+		if quit := sess.register(parseIRCMessage(line)); quit {
+			return
+		}
+	}
+
+	client := sess.client
+	defer func() {
+		if sess.joined {
+			s.leave(client)
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if quit := sess.handle(parseIRCMessage(line)); quit {
+				return
+			}
+		case reason := <-client.Kicked:
+			if sess.joined {
+				sess.send(ircServerName, "KICK", ircChannel, sess.nick, reason)
+			}
+			sess.send("", "ERROR", reason)
+			return
+		case ev := <-client.Inbox:
+			sess.deliver(ev)
+		}
+	}
+}
+
+func readIRCLines(conn net.Conn, maxLineLength int, done chan interface{}) chan string {
+	lines := make(chan string)
+
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		if maxLineLength > 0 {
+			scanner.Buffer(nil, maxLineLength)
+		}
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return lines
+}
+
+// ircUnsafe replaces the characters that would end an IRC line early.
+var ircUnsafe = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+func (sess *ircSession) send(prefix, command string, params ...string) {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + ircUnsafe.Replace(prefix) + " ")
+	}
+	b.WriteString(command)
+	for i, param := range params {
+		param = ircUnsafe.Replace(param)
+		if i == len(params)-1 && (param == "" || strings.ContainsRune(param, ' ') || strings.HasPrefix(param, ":")) {
+			param = ":" + param
+		}
+		b.WriteString(" " + param)
+	}
+	b.WriteString("\r\n")
+
+	sess.conn.Write([]byte(b.String()))
+}
+
+func (sess *ircSession) numeric(code string, params ...string) {
+	target := sess.nick
+	if target == "" {
+		target = "*"
+	}
+	sess.send(ircServerName, code, append([]string{target}, params...)...)
+}
+
+func ircHostmask(name Name) string {
+	return fmt.Sprintf("%s!%s@%s", name, name, ircServerName)
+}
+
+// register handles the commands allowed before NICK and USER have both been
+// sent, and creates the Client once they have.
+func (sess *ircSession) register(msg ircMessage) bool {
+	switch msg.Command {
+	case "CAP":
+		if len(msg.Params) > 0 && strings.ToUpper(msg.Params[0]) == "LS" {
+			sess.send(ircServerName, "CAP", "*", "LS", "")
+		}
+	case "PING":
+		sess.send(ircServerName, "PONG", append([]string{ircServerName}, msg.Params...)...)
+	case "QUIT":
+		return true
+	case "PASS":
+		if len(msg.Params) < 1 {
+			sess.numeric(errNeedMoreParams, "PASS", "Not enough parameters")
+			break
+		}
+		sess.pass = msg.Params[0]
+	case "NICK":
+		if len(msg.Params) < 1 {
+			sess.numeric(errNoNicknameGiven, "No nickname given")
+			break
+		}
+		name, err := sess.s.validateName(msg.Params[0])
+		if err != nil {
+			sess.nickError(msg.Params[0], err)
+			break
+		}
+		sess.nick = string(name)
+	case "USER":
+		if len(msg.Params) < 4 {
+			sess.numeric(errNeedMoreParams, "USER", "Not enough parameters")
+			break
+		}
+		sess.user = msg.Params[0]
+	case "":
+	default:
+		sess.numeric(errNotRegistered, "You have not registered")
+	}
+
+	if sess.nick == "" || sess.user == "" {
+		return false
+	}
+
+	name := Name(sess.nick)
+	if sess.s.Moderation != nil && sess.s.Moderation.IsBanned(sess.s.namePolicy().Key(name), sess.addr) {
+		sess.numeric(errYoureBannedCreep, "You are banned")
+		sess.send("", "ERROR", "You are banned")
+		return true
+	}
+
+	if sess.s.nameClaimed(name) && !sess.s.checkNamePassword(name, sess.pass) {
+		sess.numeric(errPasswdMismatch, "Password incorrect")
+		sess.send("", "ERROR", fmt.Sprintf("%s is registered, connect with the right PASS", name))
+		return true
+	}
+
+	sess.client = sess.s.newClient(name, sess.addr)
+	sess.client.presence.touch(time.Now())
+
+	sess.numeric(rplWelcome, fmt.Sprintf("Welcome to budgetchat, %s", ircHostmask(name)))
+	sess.numeric(rplYourHost, fmt.Sprintf("Your host is %s", ircServerName))
+	sess.numeric(rplCreated, "This server was created for protohackers")
+	sess.numeric(rplMyInfo, ircServerName, "1.0", "i", "nt")
+	sess.numeric(errNoMotd, "MOTD File is missing")
+	return false
+}
+
+func (sess *ircSession) nickError(nick string, err error) {
+	if err == ErrNameInUse {
+		sess.numeric(errNicknameInUse, nick, "Nickname is already in use")
+	} else {
+		sess.numeric(errErroneusNickname, nick, "Erroneous nickname")
+	}
+}
+
+func (sess *ircSession) handle(msg ircMessage) bool {
+	s := sess.s
+
+	switch msg.Command {
+	case "PING":
+		sess.send(ircServerName, "PONG", append([]string{ircServerName}, msg.Params...)...)
+	case "PONG", "CAP", "":
+	case "QUIT":
+		return true
+	case "NICK":
+		if len(msg.Params) > 0 && msg.Params[0] != sess.nick {
+			sess.numeric(errErroneusNickname, msg.Params[0], "Nickname changes are not supported")
+		}
+	case "USER":
+		sess.numeric(errAlreadyRegistred, "You may not reregister")
+	case "JOIN":
+		if len(msg.Params) < 1 {
+			sess.numeric(errNeedMoreParams, "JOIN", "Not enough parameters")
+			break
+		}
+		for _, channel := range strings.Split(msg.Params[0], ",") {
+			if !strings.EqualFold(channel, ircChannel) {
+				sess.numeric(errNoSuchChannel, channel, "No such channel")
+				continue
+			}
+			sess.join()
+		}
+	case "PART":
+		if len(msg.Params) < 1 {
+			sess.numeric(errNeedMoreParams, "PART", "Not enough parameters")
+			break
+		}
+		if !sess.joined || !strings.EqualFold(msg.Params[0], ircChannel) {
+			sess.numeric(errNotOnChannel, msg.Params[0], "You're not on that channel")
+			break
+		}
+		sess.send(ircHostmask(sess.client.Name), "PART", ircChannel)
+		sess.joined = false
+		s.leave(sess.client)
+	case "NAMES":
+		if sess.joined {
+			sess.names(s.listClientNames())
+		} else {
+			sess.names(nil)
+		}
+	case "WHO":
+		if sess.joined {
+			now := time.Now()
+			for _, name := range s.listClientNames() {
+				here := "H"
+				if other := s.findClient(Name(name)); other != nil && other.presence.status(now) != "" {
+					here = "G"
+				}
+				sess.numeric(rplWhoReply, ircChannel, name, ircServerName, ircServerName, name, here, "0 "+name)
+			}
+		}
+		sess.numeric(rplEndOfWho, ircChannel, "End of WHO list")
+	case "MODE":
+		if len(msg.Params) == 1 && strings.EqualFold(msg.Params[0], ircChannel) {
+			sess.numeric(rplChannelModeIs, ircChannel, "+nt")
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(msg.Params) < 1 {
+			sess.numeric(errNoRecipient, "No recipient given")
+			break
+		}
+		if len(msg.Params) < 2 || msg.Params[1] == "" {
+			sess.numeric(errNoTextToSend, "No text to send")
+			break
+		}
+		if !strings.EqualFold(msg.Params[0], ircChannel) {
+			sess.numeric(errNoSuchNick, msg.Params[0], "Private messages are not supported")
+			break
+		}
+		if !sess.joined {
+			sess.numeric(errNotOnChannel, ircChannel, "You're not on that channel")
+			break
+		}
+		if reply := s.handleLine(sess.client, msg.Params[1]); reply != "" {
+			sess.send(ircServerName, "NOTICE", sess.nick, strings.TrimPrefix(reply, "* "))
+		}
+	default:
+		sess.numeric(errUnknownCommand, msg.Command, "Unknown command")
+	}
+
+	return false
+}
+
+func (sess *ircSession) join() {
+	if sess.joined {
+		return
+	}
+	names, history, err := sess.s.join(sess.client)
+	if err != nil {
+		sess.nickError(sess.nick, err)
+		return
+	}
+	sess.joined = true
+
+	sess.send(ircHostmask(sess.client.Name), "JOIN", ircChannel)
+	sess.numeric(rplNoTopic, ircChannel, "No topic is set")
+	sess.names(append(names, string(sess.client.Name)))
+
+	for _, line := range history {
+		sess.send(ircServerName, "NOTICE", ircChannel, strings.TrimPrefix(line, "* "))
+	}
+}
+
+// names sends RPL_NAMREPLY in chunks that keep each line well under the 512
+// byte limit.
+func (sess *ircSession) names(names []string) {
+	const maxLength = 400
+
+	var chunk []string
+	length := 0
+	for _, name := range names {
+		if len(chunk) > 0 && length+1+len(name) > maxLength {
+			sess.numeric(rplNamReply, "=", ircChannel, strings.Join(chunk, " "))
+			chunk = nil
+			length = 0
+		}
+		chunk = append(chunk, name)
+		length += len(name) + 1
+	}
+	if len(chunk) > 0 {
+		sess.numeric(rplNamReply, "=", ircChannel, strings.Join(chunk, " "))
+	}
+	sess.numeric(rplEndOfNames, ircChannel, "End of /NAMES list")
+}
+
+func (sess *ircSession) deliver(ev Event) {
+	switch ev.Kind {
+	case EventJoin:
+		sess.send(ircHostmask(ev.Sender), "JOIN", ircChannel)
+	case EventLeave:
+		sess.send(ircHostmask(ev.Sender), "PART", ircChannel)
+	default:
+		sess.send(ircHostmask(ev.Sender), "PRIVMSG", ircChannel, ev.Text)
+	}
+}
@@ -0,0 +1,120 @@
+package budgetchat
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIRCMessage(t *testing.T) {
+	tests := []struct {
+		Line   string
+		Parsed ircMessage
+	}{
+		{
+			Line:   "NICK alice\r\n",
+			Parsed: ircMessage{Command: "NICK", Params: []string{"alice"}},
+		},
+		{
+			Line:   "USER alice 0 * :Alice Liddell",
+			Parsed: ircMessage{Command: "USER", Params: []string{"alice", "0", "*", "Alice Liddell"}},
+		},
+		{
+			Line:   ":alice!alice@host privmsg #budgetchat :hello  there",
+			Parsed: ircMessage{Prefix: "alice!alice@host", Command: "PRIVMSG", Params: []string{"#budgetchat", "hello  there"}},
+		},
+		{
+			Line:   "PING :",
+			Parsed: ircMessage{Command: "PING", Params: []string{""}},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.Parsed, parseIRCMessage(test.Line))
+	}
+}
+
+func startIRCServer(t *testing.T, s *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleIRCConnection(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// expectIRC skips lines until one with the given command, and returns it.
+func (c *testClient) expectIRC(t *testing.T, command string) string {
+	t.Helper()
+	for {
+		line := c.read(t)
+		if parseIRCMessage(line).Command == command {
+			return strings.TrimSuffix(line, "\r")
+		}
+	}
+}
+
+func TestIRCSharesRoomWithTCP(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	ircAddr := startIRCServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+
+	conn, err := net.Dial("tcp", ircAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := newTestClient(t, conn)
+	bob.send(t, "CAP LS 302")
+	bob.send(t, "NICK alice")
+	bob.expectIRC(t, errNicknameInUse)
+	bob.send(t, "NICK bob")
+	bob.send(t, "USER bob 0 * :Bob")
+	bob.expectIRC(t, rplWelcome)
+
+	bob.send(t, "JOIN #budgetchat")
+	assert.Equal(t, ":bob!bob@budgetchat JOIN #budgetchat", bob.expectIRC(t, "JOIN"))
+	names := parseIRCMessage(bob.expectIRC(t, rplNamReply)).Params
+	assert.ElementsMatch(t, []string{"alice", "bob"}, strings.Fields(names[len(names)-1]))
+	alice.expect(t, "* bob has entered the room")
+
+	bob.send(t, "PRIVMSG #budgetchat :hi alice")
+	alice.expect(t, "[bob] hi alice")
+
+	alice.send(t, "hi\r:admin!admin@budgetchat PRIVMSG #budgetchat :forged")
+	alice.expect(t, "* Messages cannot contain line breaks or NUL characters")
+	alice.send(t, "hi bob")
+	assert.Equal(t, ":alice!alice@budgetchat PRIVMSG #budgetchat :hi bob", bob.expectIRC(t, "PRIVMSG"))
+
+	bob.send(t, "PART #budgetchat")
+	alice.expect(t, "* bob has left the room")
+}
+
+func TestIRCSendStripsLineBreaks(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	sess := &ircSession{conn: server}
+
+	go func() {
+		sess.send("alice!alice@budgetchat", "PRIVMSG", ircChannel, "hi\r\n:admin PRIVMSG #budgetchat :forged\x00")
+		server.Close()
+	}()
+	data, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, ":alice!alice@budgetchat PRIVMSG #budgetchat :hi  :admin PRIVMSG #budgetchat :forged \r\n", string(data))
+}
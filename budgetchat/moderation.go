@@ -0,0 +1,196 @@
+package budgetchat
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	FilterRedact = "redact"
+	FilterReject = "reject"
+)
+
+var ErrMessageRejected = errors.New("message rejected by word filter")
+
+// Moderation holds the operator password, word filter and ban/mute state. Bans
+// are persisted to BanFile (when set) so they survive restarts. Names are
+// banned and muted by their NamePolicy key, so every spelling the policy
+// considers the same name is covered.
+type Moderation struct {
+	OperatorPassword string
+	BanFile          string
+	FilterMode       string
+
+	filter      *regexp.Regexp
+	bannedNames map[string]bool
+	bannedIPs   map[string]bool
+	mutes       map[string]time.Time
+	mu          sync.Mutex
+}
+
+type banList struct {
+	Names []string `json:"names"`
+	IPs   []string `json:"ips"`
+}
+
+func NewModeration(operatorPassword, banFile string) (*Moderation, error) {
+	m := &Moderation{
+		OperatorPassword: operatorPassword,
+		BanFile:          banFile,
+		FilterMode:       FilterRedact,
+		bannedNames:      make(map[string]bool),
+		bannedIPs:        make(map[string]bool),
+		mutes:            make(map[string]time.Time),
+	}
+
+	if banFile == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(banFile)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bans banList
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	for _, name := range bans.Names {
+		m.bannedNames[name] = true
+	}
+	for _, ip := range bans.IPs {
+		m.bannedIPs[ip] = true
+	}
+	return m, nil
+}
+
+// SetFilter configures the words that are redacted or rejected, matched
+// case-insensitively on word boundaries.
+func (m *Moderation) SetFilter(words []string, mode string) error {
+	if mode != FilterRedact && mode != FilterReject {
+		return errors.New("filter mode must be redact or reject")
+	}
+
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.FilterMode = mode
+	m.filter = nil
+	if len(quoted) > 0 {
+		m.filter = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return nil
+}
+
+func (m *Moderation) Filter(msg string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filter == nil || !m.filter.MatchString(msg) {
+		return msg, nil
+	}
+	if m.FilterMode == FilterReject {
+		return "", ErrMessageRejected
+	}
+	return m.filter.ReplaceAllStringFunc(msg, func(word string) string {
+		return strings.Repeat("*", len(word))
+	}), nil
+}
+
+func (m *Moderation) IsOperatorPassword(password string) bool {
+	return m.OperatorPassword != "" && password == m.OperatorPassword
+}
+
+func (m *Moderation) IsBanned(nameKey, ip string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bannedNames[nameKey] || m.bannedIPs[ip]
+}
+
+func (m *Moderation) BanName(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bannedNames[key] = true
+	return m.save()
+}
+
+func (m *Moderation) BanIP(ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bannedIPs[ip] = true
+	return m.save()
+}
+
+// Unban lifts a ban on either the name with nameKey or ip, reporting whether
+// one existed.
+func (m *Moderation) Unban(nameKey, ip string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := m.bannedNames[nameKey] || m.bannedIPs[ip]
+	delete(m.bannedNames, nameKey)
+	delete(m.bannedIPs, ip)
+	if !found {
+		return false, nil
+	}
+	return true, m.save()
+}
+
+func (m *Moderation) Mute(key string, d time.Duration) {
+	m.mu.Lock()
+	m.mutes[key] = time.Now().Add(d)
+	m.mu.Unlock()
+}
+
+func (m *Moderation) Unmute(key string) {
+	m.mu.Lock()
+	delete(m.mutes, key)
+	m.mu.Unlock()
+}
+
+func (m *Moderation) IsMuted(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	until, ok := m.mutes[key]
+	if ok && time.Now().After(until) {
+		delete(m.mutes, key)
+		return false
+	}
+	return ok
+}
+
+// save must be called with m.mu held.
+func (m *Moderation) save() error {
+	if m.BanFile == "" {
+		return nil
+	}
+
+	bans := banList{Names: maps.Keys(m.bannedNames), IPs: maps.Keys(m.bannedIPs)}
+	slices.Sort(bans.Names)
+	slices.Sort(bans.IPs)
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.BanFile, data)
+}
@@ -0,0 +1,103 @@
+package budgetchat
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModerationFilter(t *testing.T) {
+	m, err := NewModeration("", "")
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.SetFilter([]string{"darn", " heck "}, FilterRedact))
+	msg, err := m.Filter("Darn it, what the heck")
+	assert.Nil(t, err)
+	assert.Equal(t, "**** it, what the ****", msg)
+
+	msg, err = m.Filter("darned if I know")
+	assert.Nil(t, err)
+	assert.Equal(t, "darned if I know", msg)
+
+	assert.Nil(t, m.SetFilter([]string{"darn"}, FilterReject))
+	_, err = m.Filter("darn")
+	assert.Equal(t, ErrMessageRejected, err)
+}
+
+func TestModerationBansPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+
+	m, err := NewModeration("", path)
+	assert.Nil(t, err)
+	assert.Nil(t, m.BanName("mallory"))
+	assert.Nil(t, m.BanIP("10.0.0.1"))
+
+	m, err = NewModeration("", path)
+	assert.Nil(t, err)
+	assert.True(t, m.IsBanned("mallory", "127.0.0.1"))
+	assert.True(t, m.IsBanned("alice", "10.0.0.1"))
+	assert.False(t, m.IsBanned("alice", "127.0.0.1"))
+
+	found, err := m.Unban("mallory", "")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.False(t, m.IsBanned("mallory", "127.0.0.1"))
+}
+
+func TestBanIPNeedsAnAddress(t *testing.T) {
+	s := NewServer()
+	moderation, err := NewModeration("hunter2", "")
+	assert.Nil(t, err)
+	s.Moderation = moderation
+	assert.Nil(t, s.AddBot(&DiceBot{}))
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+	alice.send(t, "/oper hunter2")
+	assert.Equal(t, "* You are now an operator", alice.read(t))
+
+	alice.send(t, "/banip dicebot")
+	assert.Equal(t, "* dicebot is a bot and has no IP to ban", alice.read(t))
+	assert.False(t, s.Moderation.IsBanned("alice", botAddr))
+}
+
+func TestModerationIgnoresCase(t *testing.T) {
+	s := NewServer()
+	s.NamePolicy = FlexibleNamePolicy{CaseInsensitive: true}
+	moderation, err := NewModeration("hunter2", "")
+	assert.Nil(t, err)
+	s.Moderation = moderation
+	addr := startServer(t, s)
+
+	op, _ := join(t, addr, "op")
+	op.send(t, "/oper hunter2")
+	op.expect(t, "* You are now an operator")
+
+	alice, _ := join(t, addr, "Alice")
+	op.expect(t, "* Alice has entered the room")
+
+	op.send(t, "/mute alice")
+	op.expect(t, "* Muted alice for 5m0s")
+	alice.send(t, "hello")
+	alice.expect(t, "* You are muted")
+	op.send(t, "/unmute ALICE")
+	op.expect(t, "* Unmuted ALICE")
+	alice.send(t, "hello")
+	op.expect(t, "[Alice] hello")
+
+	op.send(t, "/kick aLiCe")
+	op.expect(t, "* Kicked Alice")
+	alice.expect(t, "* You were kicked by op")
+	op.expect(t, "* Alice has left the room")
+
+	alice, _ = join(t, addr, "Alice")
+	op.expect(t, "* Alice has entered the room")
+	op.send(t, "/ban ALICE")
+	op.expect(t, "* Banned ALICE")
+	alice.expect(t, "* You were banned by op")
+	op.expect(t, "* Alice has left the room")
+
+	_, reply := join(t, addr, "alice")
+	assert.Equal(t, "* You are banned", reply)
+}
@@ -0,0 +1,234 @@
+package budgetchat
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrReservedName = errors.New("name is reserved")
+
+// NamePolicy decides which names are acceptable and when two names count as
+// the same name.
+type NamePolicy interface {
+	// Normalize validates a requested name and returns the form it is shown as.
+	Normalize(raw string) (Name, error)
+	// Key returns the form names are compared by for uniqueness.
+	Key(name Name) string
+}
+
+// SpecNamePolicy is the policy from the protocol spec: ASCII letters and
+// digits, compared byte for byte.
+type SpecNamePolicy struct{}
+
+func (SpecNamePolicy) Normalize(raw string) (Name, error) {
+	if !nameRegex.MatchString(raw) {
+		return "", ErrInvalidName
+	}
+	return Name(raw), nil
+}
+
+func (SpecNamePolicy) Key(name Name) string {
+	return string(name)
+}
+
+// FlexibleNamePolicy allows configuring length limits (in characters),
+// Unicode letters (normalised to NFC), case-insensitive uniqueness and
+// reserved names.
+type FlexibleNamePolicy struct {
+	MinLength       int
+	MaxLength       int
+	Unicode         bool
+	CaseInsensitive bool
+	Reserved        []string
+}
+
+func (p FlexibleNamePolicy) Normalize(raw string) (Name, error) {
+	if !utf8.ValidString(raw) {
+		return "", ErrInvalidName
+	}
+	name := norm.NFC.String(raw)
+
+	length := utf8.RuneCountInString(name)
+	if length == 0 || length < p.MinLength || (p.MaxLength > 0 && length > p.MaxLength) {
+		return "", ErrInvalidName
+	}
+
+	for i, r := range name {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case p.Unicode && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case p.Unicode && i > 0 && unicode.Is(unicode.Mn, r):
+		default:
+			return "", ErrInvalidName
+		}
+	}
+
+	for _, reserved := range p.Reserved {
+		if p.Key(Name(norm.NFC.String(reserved))) == p.Key(Name(name)) {
+			return "", ErrReservedName
+		}
+	}
+
+	return Name(name), nil
+}
+
+func (p FlexibleNamePolicy) Key(name Name) string {
+	if p.CaseInsensitive {
+		return norm.NFC.String(cases.Fold().String(string(name)))
+	}
+	return string(name)
+}
+
+func (s *Server) namePolicy() NamePolicy {
+	if s.NamePolicy == nil {
+		return SpecNamePolicy{}
+	}
+	return s.NamePolicy
+}
+
+// nameClaim holds a bcrypt hash of the password. Claims made before bcrypt was
+// used have a Salt and a salted SHA-256 Hash instead, and are still accepted.
+type nameClaim struct {
+	Name Name   `json:"name"`
+	Salt string `json:"salt,omitempty"`
+	Hash string `json:"hash"`
+}
+
+// NameRegistry lets users claim a name with a password so that nobody else
+// can use it. Claims are keyed by NamePolicy.Key and persisted to Path.
+type NameRegistry struct {
+	Path string
+
+	claims map[string]nameClaim
+	mu     sync.Mutex
+}
+
+func OpenNameRegistry(path string) (*NameRegistry, error) {
+	r := &NameRegistry{
+		Path:   path,
+		claims: make(map[string]nameClaim),
+	}
+
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.claims); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func legacyHashPassword(salt, password string) string {
+	h := sha256.Sum256([]byte(salt + "\x00" + password))
+	return hex.EncodeToString(h[:])
+}
+
+func (c nameClaim) matches(password string) bool {
+	if c.Salt != "" {
+		hash := legacyHashPassword(c.Salt, password)
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(c.Hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(password)) == nil
+}
+
+func (r *NameRegistry) IsClaimed(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.claims[key]
+	return ok
+}
+
+func (r *NameRegistry) CheckPassword(key, password string) bool {
+	r.mu.Lock()
+	claim, ok := r.claims[key]
+	r.mu.Unlock()
+
+	return ok && claim.matches(password)
+}
+
+// Claim registers or updates the password for a name.
+func (r *NameRegistry) Claim(key string, name Name, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	claim := nameClaim{Name: name, Hash: string(hash)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.claims[key] = claim
+	if r.Path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.Path, data)
+}
+
+func (s *Server) nameClaimed(name Name) bool {
+	return s.Registry != nil && s.Registry.IsClaimed(s.namePolicy().Key(name))
+}
+
+func (s *Server) checkNamePassword(name Name, password string) bool {
+	return s.Registry == nil || s.Registry.CheckPassword(s.namePolicy().Key(name), password)
+}
+
+func cmdRegister(s *Server, client *Client, args []string) string {
+	if s.Registry == nil {
+		return "* Name registration is disabled"
+	}
+	if len(args) != 1 {
+		return "* Usage: /register <password>"
+	}
+	if client.Origin != "" {
+		return "* Remote users cannot register names here"
+	}
+
+	key := s.namePolicy().Key(client.Name)
+	if err := s.Registry.Claim(key, client.Name, args[0]); err != nil {
+		return fmt.Sprintf("* Could not register %s: %s", client.Name, err)
+	}
+	return fmt.Sprintf("* %s is now registered to you", client.Name)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
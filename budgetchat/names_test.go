@@ -0,0 +1,101 @@
+package budgetchat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlexibleNamePolicy(t *testing.T) {
+	policy := FlexibleNamePolicy{
+		MinLength:       2,
+		MaxLength:       8,
+		Unicode:         true,
+		CaseInsensitive: true,
+		Reserved:        []string{"Admin"},
+	}
+
+	tests := []struct {
+		Raw  string
+		Name Name
+		Err  error
+	}{
+		{Raw: "alice", Name: "alice"},
+		{Raw: "Zo\u00eb", Name: "Zo\u00eb"},
+		{Raw: "Zoe\u0308", Name: "Zo\u00eb"}, // combining diaeresis is composed
+		{Raw: "x", Err: ErrInvalidName},
+		{Raw: "verylongname", Err: ErrInvalidName},
+		{Raw: "bad name", Err: ErrInvalidName},
+		{Raw: "\u0308abc", Err: ErrInvalidName},
+		{Raw: "ADMIN", Err: ErrReservedName},
+	}
+
+	for _, test := range tests {
+		name, err := policy.Normalize(test.Raw)
+		assert.Equal(t, test.Err, err, test.Raw)
+		assert.Equal(t, test.Name, name, test.Raw)
+	}
+
+	assert.Equal(t, policy.Key("Straße"), policy.Key("STRASSE"))
+	assert.NotEqual(t, SpecNamePolicy{}.Key("Alice"), SpecNamePolicy{}.Key("alice"))
+}
+
+func TestNameUniquenessFollowsPolicy(t *testing.T) {
+	s := NewServer()
+	s.NamePolicy = FlexibleNamePolicy{CaseInsensitive: true}
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "Alice")
+	alice.send(t, "hi")
+
+	_, err := s.validateName("alice")
+	assert.Equal(t, ErrNameInUse, err)
+}
+
+func TestNameRegistration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "names.json")
+	registry, err := OpenNameRegistry(path)
+	assert.Nil(t, err)
+
+	s := NewServer()
+	s.Registry = registry
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+	alice.send(t, "/register hunter2")
+	alice.expect(t, "* alice is now registered to you")
+	alice.conn.Close()
+
+	reopened, err := OpenNameRegistry(path)
+	assert.Nil(t, err)
+	assert.True(t, reopened.CheckPassword("alice", "hunter2"))
+
+	impostor, prompt := join(t, addr, "alice")
+	assert.Equal(t, "* alice is registered. Password?", prompt)
+	impostor.send(t, "letmein")
+	impostor.expect(t, "* Wrong password")
+
+	owner, prompt := join(t, addr, "alice")
+	assert.Equal(t, "* alice is registered. Password?", prompt)
+	owner.send(t, "hunter2")
+	owner.expect(t, "* The room contains: ")
+}
+
+func TestNameRegistryHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "names.json")
+	legacy := `{"bob": {"name": "bob", "salt": "pepper", "hash": "` + legacyHashPassword("pepper", "swordfish") + `"}}`
+	assert.Nil(t, os.WriteFile(path, []byte(legacy), 0600))
+
+	registry, err := OpenNameRegistry(path)
+	assert.Nil(t, err)
+	assert.True(t, registry.CheckPassword("bob", "swordfish"), "claims from before bcrypt still work")
+	assert.False(t, registry.CheckPassword("bob", "letmein"))
+
+	assert.Nil(t, registry.Claim("alice", "alice", "hunter2"))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"hash": "$2a$`)
+	assert.NotContains(t, string(data), "hunter2")
+}
@@ -0,0 +1,123 @@
+package budgetchat
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+var (
+	rateLimitedMessages = expvar.NewInt("budgetchat_rate_limited_messages")
+	floodDisconnects    = expvar.NewInt("budgetchat_flood_disconnects")
+)
+
+// RateLimit configures per-client token buckets. A zero rate disables that
+// bucket. Clients are disconnected after MaxViolations dropped messages (0
+// means never).
+type RateLimit struct {
+	MessagesPerSecond float64
+	MessageBurst      int
+	BytesPerSecond    float64
+	ByteBurst         int
+	MaxViolations     int
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if float64(burst) < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// limiter is owned by a single client goroutine and needs no locking.
+type limiter struct {
+	config     RateLimit
+	messages   *tokenBucket
+	bytes      *tokenBucket
+	violations int
+}
+
+func newLimiter(config RateLimit) *limiter {
+	now := time.Now()
+	return &limiter{
+		config:   config,
+		messages: newTokenBucket(config.MessagesPerSecond, config.MessageBurst, now),
+		bytes:    newTokenBucket(config.BytesPerSecond, config.ByteBurst, now),
+	}
+}
+
+// tooLong reports whether msg is bigger than the byte burst, so that it could
+// never be allowed however long the client waits.
+func (l *limiter) tooLong(msg string) bool {
+	return l.bytes != nil && float64(len(msg)+1) > l.bytes.burst
+}
+
+func (l *limiter) allow(now time.Time, msg string) bool {
+	size := float64(len(msg) + 1)
+
+	if l.messages != nil {
+		l.messages.refill(now)
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+	}
+
+	if (l.messages != nil && l.messages.tokens < 1) || (l.bytes != nil && l.bytes.tokens < size) {
+		l.violations++
+		return false
+	}
+
+	if l.messages != nil {
+		l.messages.tokens--
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= size
+	}
+	return true
+}
+
+// checkRate returns a warning for the client when msg should be dropped.
+func (s *Server) checkRate(client *Client, msg string) (string, bool) {
+	if client.limiter == nil {
+		return "", true
+	}
+	// Waiting would not help, so this is not held against the client.
+	if client.limiter.tooLong(msg) {
+		return fmt.Sprintf("* Line too long, the limit is %d bytes", int(client.limiter.bytes.burst)-1), false
+	}
+	if client.limiter.allow(time.Now(), msg) {
+		return "", true
+	}
+
+	rateLimitedMessages.Add(1)
+
+	max := client.limiter.config.MaxViolations
+	if max > 0 && client.limiter.violations >= max {
+		floodDisconnects.Add(1)
+		client.Kick("Disconnected for flooding")
+		return "", false
+	}
+
+	if max > 0 {
+		return fmt.Sprintf("* Slow down! Message dropped (warning %d of %d)", client.limiter.violations, max), false
+	}
+	return "* Slow down! Message dropped", false
+}
@@ -0,0 +1,64 @@
+package budgetchat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{MessagesPerSecond: 1, MessageBurst: 2, BytesPerSecond: 10, ByteBurst: 10})
+	now := l.messages.last
+
+	assert.True(t, l.allow(now, "hi"))
+	assert.True(t, l.allow(now, "hi"))
+	assert.False(t, l.allow(now, "hi"), "message burst exhausted")
+
+	now = now.Add(time.Second)
+	assert.False(t, l.allow(now, "this line is too long"), "byte budget exceeded")
+
+	now = now.Add(time.Second)
+	assert.True(t, l.allow(now, "hi"))
+	assert.Equal(t, 2, l.violations)
+}
+
+func TestFloodDisconnect(t *testing.T) {
+	s := NewServer()
+	s.RateLimit = &RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2, MaxViolations: 2}
+	addr := startServer(t, s)
+	disconnects := floodDisconnects.Value()
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	for i := 0; i < 4; i++ {
+		alice.send(t, "spam")
+	}
+	alice.expect(t, "* Slow down! Message dropped (warning 1 of 2)")
+	alice.expect(t, "* Disconnected for flooding")
+	assert.False(t, alice.scanner.Scan(), "connection closed")
+
+	bob.expect(t, "[alice] spam")
+	bob.expect(t, "[alice] spam")
+	bob.expect(t, "* alice has left the room")
+	assert.Equal(t, disconnects+1, floodDisconnects.Value())
+}
+
+func TestLineLongerThanByteBurst(t *testing.T) {
+	s := NewServer()
+	s.RateLimit = &RateLimit{BytesPerSecond: 1000, ByteBurst: 11, MaxViolations: 1}
+	addr := startServer(t, s)
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	for i := 0; i < 3; i++ {
+		alice.send(t, "this will never fit")
+		alice.expect(t, "* Line too long, the limit is 10 bytes")
+	}
+	alice.send(t, "this fits")
+	bob.expect(t, "[alice] this fits")
+}
@@ -0,0 +1,76 @@
+package budgetchat
+
+import (
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	RosterJoinOrder    = "join"
+	RosterAlphabetical = "alpha"
+)
+
+// listClientNamesLocked returns everyone in the room in roster order. The
+// caller must hold s.ClientsMux.
+func (s *Server) listClientNamesLocked() []string {
+	clients := make([]*Client, 0, len(s.Clients))
+	for _, client := range s.Clients {
+		clients = append(clients, client)
+	}
+
+	if s.RosterOrder == RosterAlphabetical {
+		policy := s.namePolicy()
+		slices.SortFunc(clients, func(a, b *Client) bool {
+			ka, kb := policy.Key(a.Name), policy.Key(b.Name)
+			if ka != kb {
+				return ka < kb
+			}
+			return a.Name < b.Name
+		})
+	} else {
+		slices.SortFunc(clients, func(a, b *Client) bool {
+			return a.joinSeq < b.joinSeq
+		})
+	}
+
+	names := make([]string, len(clients))
+	for i, client := range clients {
+		names[i] = string(client.Name)
+	}
+	return names
+}
+
+// rosterLines renders the roster sent to a new member, wrapped according to
+// RosterLineLength. A single name longer than the limit gets a line to itself.
+func (s *Server) rosterLines(names []string) []string {
+	const (
+		first = "* The room contains: "
+		more  = "* The room also contains: "
+	)
+
+	if s.RosterLineLength <= 0 {
+		return []string{first + strings.Join(names, ", ")}
+	}
+
+	lines := make([]string, 0, 1)
+	prefix := first
+	var line []string
+	length := len(prefix)
+
+	for _, name := range names {
+		if len(line) > 0 && length+2+len(name) > s.RosterLineLength {
+			lines = append(lines, prefix+strings.Join(line, ", "))
+			prefix = more
+			line = nil
+			length = len(prefix)
+		}
+		if len(line) > 0 {
+			length += 2
+		}
+		line = append(line, name)
+		length += len(name)
+	}
+
+	return append(lines, prefix+strings.Join(line, ", "))
+}
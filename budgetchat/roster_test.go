@@ -0,0 +1,145 @@
+package budgetchat
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
+)
+
+func TestRosterJoinOrder(t *testing.T) {
+	addr := startServer(t, NewServer())
+
+	join(t, addr, "carol")
+	join(t, addr, "alice")
+	join(t, addr, "bob")
+
+	_, roster := join(t, addr, "dave")
+	assert.Equal(t, "* The room contains: carol, alice, bob", roster)
+}
+
+func TestRosterAlphabetical(t *testing.T) {
+	s := NewServer()
+	s.RosterOrder = RosterAlphabetical
+	s.NamePolicy = FlexibleNamePolicy{CaseInsensitive: true}
+	addr := startServer(t, s)
+
+	join(t, addr, "carol")
+	join(t, addr, "bob")
+	join(t, addr, "Alice")
+
+	_, roster := join(t, addr, "dave")
+	assert.Equal(t, "* The room contains: Alice, bob, carol", roster)
+}
+
+func TestRosterLines(t *testing.T) {
+	s := NewServer()
+	names := []string{"alice", "bob", "carol", "dave", "averyveryverylongname"}
+
+	assert.Equal(t, []string{"* The room contains: "}, s.rosterLines(nil))
+	assert.Equal(t, []string{"* The room contains: alice, bob, carol, dave, averyveryverylongname"}, s.rosterLines(names))
+
+	s.RosterLineLength = 35
+	assert.Equal(t, []string{
+		"* The room contains: alice, bob",
+		"* The room also contains: carol",
+		"* The room also contains: dave",
+		"* The room also contains: averyveryverylongname",
+	}, s.rosterLines(names))
+}
+
+func TestRosterWrapsForNewMembers(t *testing.T) {
+	s := NewServer()
+	s.RosterLineLength = 30
+	addr := startServer(t, s)
+
+	join(t, addr, "alice")
+	join(t, addr, "bob")
+	join(t, addr, "carol")
+
+	dave, roster := join(t, addr, "dave")
+	assert.Equal(t, "* The room contains: alice", roster)
+	dave.expect(t, "* The room also contains: bob")
+	dave.expect(t, "* The room also contains: carol")
+}
+
+// Every pair of members that join at the same time must learn about each other
+// exactly once: either from the roster or from a join event, never both.
+func TestConcurrentJoins(t *testing.T) {
+	s := NewServer()
+
+	clients := make([]*Client, 8)
+	rosters := make([][]string, len(clients))
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		clients[i] = s.newClient(Name(fmt.Sprintf("user%d", i)), "test")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			names, _, err := s.join(clients[i])
+			assert.Nil(t, err)
+			rosters[i] = names
+		}(i)
+	}
+	wg.Wait()
+
+	for i, client := range clients {
+		seen := append([]string(nil), rosters[i]...)
+		// Join events reach the inbox asynchronously, so wait for the ones
+		// that are missing, and then a little longer for any extras.
+	collect:
+		for {
+			wait := 50 * time.Millisecond
+			if len(seen) < len(clients)-1 {
+				wait = time.Second
+			}
+			select {
+			case ev := <-client.Inbox:
+				assert.Equal(t, EventJoin, ev.Kind)
+				seen = append(seen, string(ev.Sender))
+			case <-time.After(wait):
+				break collect
+			}
+		}
+
+		assert.NotContains(t, seen, string(client.Name))
+		assert.Len(t, seen, len(clients)-1)
+		slices.Sort(seen)
+		assert.Equal(t, len(seen), len(slices.Compact(seen)), "%s heard about someone twice", client.Name)
+	}
+
+	assert.Len(t, s.listClientNames(), len(clients))
+}
+
+func TestJoinRejectsDuplicateName(t *testing.T) {
+	s := NewServer()
+
+	first := s.newClient("alice", "test")
+	_, _, err := s.join(first)
+	assert.Nil(t, err)
+
+	_, _, err = s.join(s.newClient("alice", "test"))
+	assert.Equal(t, ErrNameInUse, err)
+
+	// Leaving with a client that never joined must not remove the real one.
+	s.leave(s.newClient("alice", "test"))
+	assert.Equal(t, []string{"alice"}, s.listClientNames())
+}
+
+func TestMessageBeforeLeave(t *testing.T) {
+	addr := startServer(t, NewServer())
+
+	alice, _ := join(t, addr, "alice")
+	bob, _ := join(t, addr, "bob")
+	alice.expect(t, "* bob has entered the room")
+
+	bob.send(t, "bye")
+	bob.conn.Close()
+
+	alice.expect(t, "[bob] bye")
+	alice.expect(t, "* bob has left the room")
+}
@@ -0,0 +1,133 @@
+package budgetchat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Record struct {
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	Event
+}
+
+// Transcript is an append-only JSON lines log of everything said in a room.
+// Once the file grows past MaxBytes it is rotated to path.1, path.2, ... and
+// at most MaxFiles old files are kept.
+type Transcript struct {
+	Path     string
+	Room     string
+	MaxBytes int64
+	MaxFiles int
+
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+func OpenTranscript(path, room string, maxBytes int64, maxFiles int) (*Transcript, error) {
+	t := &Transcript{
+		Path:     path,
+		Room:     room,
+		MaxBytes: maxBytes,
+		MaxFiles: maxFiles,
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Transcript) open() error {
+	file, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+func (t *Transcript) Write(rec Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Room = t.Room
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.MaxBytes > 0 && t.size > 0 && t.size+int64(len(line)) > t.MaxBytes {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.file.Write(line)
+	t.size += int64(n)
+	return err
+}
+
+func (t *Transcript) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	for i := t.MaxFiles; i > 0; i-- {
+		src := t.Path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", t.Path, i-1)
+		}
+		err := os.Rename(src, fmt.Sprintf("%s.%d", t.Path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if t.MaxFiles <= 0 {
+		if err := os.Remove(t.Path); err != nil {
+			return err
+		}
+	}
+
+	return t.open()
+}
+
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+// ReadTranscript calls fn for every record in r, stopping at the first error.
+func ReadTranscript(r io.Reader, fn func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,45 @@
+package budgetchat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranscriptRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.log")
+	transcript, err := OpenTranscript(path, "lobby", 100, 1)
+	assert.Nil(t, err)
+
+	for _, text := range []string{"first", "second", "third"} {
+		assert.Nil(t, transcript.Write(Record{Event: Event{Kind: EventMessage, Sender: "alice", Text: text}}))
+	}
+	assert.Nil(t, transcript.Close())
+
+	read := func(path string) []Record {
+		f, err := os.Open(path)
+		assert.Nil(t, err)
+		defer f.Close()
+
+		records := make([]Record, 0)
+		assert.Nil(t, ReadTranscript(f, func(rec Record) error {
+			records = append(records, rec)
+			return nil
+		}))
+		return records
+	}
+
+	current := read(path)
+	assert.Len(t, current, 1)
+	assert.Equal(t, "third", current[0].Text)
+	assert.Equal(t, "lobby", current[0].Room)
+
+	rotated := read(path + ".1")
+	assert.Len(t, rotated, 1)
+	assert.Equal(t, "second", rotated[0].Text)
+
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,53 @@
+package budgetchat
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/veggiedefender/protohackers/websocket"
+)
+
+const webClientPage = `<!doctype html>
+<title>budgetchat</title>
+<pre id="log"></pre>
+<form id="form"><input id="input" autofocus autocomplete="off" size="80"></form>
+<script>
+const log = document.getElementById("log");
+const input = document.getElementById("input");
+const ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws");
+ws.onmessage = (e) => { log.textContent += e.data + "\n"; };
+ws.onclose = () => { log.textContent += "* disconnected\n"; };
+document.getElementById("form").onsubmit = (e) => {
+	e.preventDefault();
+	ws.send(input.value);
+	input.value = "";
+};
+</script>
+`
+
+// WebSocketHandler serves a minimal browser client on / and chat sessions on
+// /ws. WebSocket users share the room with TCP users.
+func (s *Server) WebSocketHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(webClientPage))
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		s.handleConnection(conn)
+	})
+	return mux
+}
+
+func (s *Server) ListenWebSocket(addr string) {
+	log.Fatal(http.ListenAndServe(addr, s.WebSocketHandler()))
+}
@@ -0,0 +1,37 @@
+package budgetchat
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/veggiedefender/protohackers/websocket"
+)
+
+func TestWebSocketSharesRoomWithTCP(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	web := httptest.NewServer(s.WebSocketHandler())
+	defer web.Close()
+
+	alice, _ := join(t, addr, "alice")
+
+	conn, err := websocket.Dial("ws" + strings.TrimPrefix(web.URL, "http") + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := newTestClient(t, conn)
+	bob.expect(t, "Welcome to budgetchat! What shall I call you?")
+	bob.send(t, "bob")
+	bob.expect(t, "* The room contains: alice")
+	alice.expect(t, "* bob has entered the room")
+
+	bob.send(t, "hello from the browser")
+	alice.expect(t, "[bob] hello from the browser")
+
+	alice.send(t, "hello from tcp")
+	bob.expect(t, "[alice] hello from tcp")
+
+	conn.Close()
+	alice.expect(t, "* bob has left the room")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/veggiedefender/protohackers/budgetchat"
+)
+
+// chatlog searches budgetchat transcripts and replays matching records to
+// stdout, e.g. `protohackers chatlog -sender alice -since 1h chat.log`.
+func chatlog(args []string) int {
+	fs := flag.NewFlagSet("chatlog", flag.ExitOnError)
+	grep := fs.String("grep", "", "only show messages matching this regexp")
+	sender := fs.String("sender", "", "only show records from this sender")
+	since := fs.Duration("since", 0, "only show records newer than this")
+	events := fs.Bool("events", true, "include join and leave events")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protohackers chatlog [flags] transcript...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var pattern *regexp.Regexp
+	if *grep != "" {
+		var err error
+		pattern, err = regexp.Compile(*grep)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	var cutoff time.Time
+	if *since > 0 {
+		cutoff = time.Now().Add(-*since)
+	}
+
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		err = budgetchat.ReadTranscript(f, func(rec budgetchat.Record) error {
+			switch {
+			case rec.Time.Before(cutoff):
+			case *sender != "" && string(rec.Sender) != *sender:
+			case rec.Kind != budgetchat.EventMessage && (!*events || pattern != nil):
+			case pattern != nil && !pattern.MatchString(rec.Text):
+			default:
+				fmt.Printf("%s %s\n", rec.Time.Format("2006-01-02 15:04:05"), rec)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+	}
+
+	return 0
+}
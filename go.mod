@@ -4,7 +4,9 @@ go 1.19
 
 require (
 	github.com/stretchr/testify v1.8.1
+	golang.org/x/crypto v0.14.0
 	golang.org/x/exp v0.0.0-20221006183845-316c7553db56
+	golang.org/x/text v0.14.0
 )
 
 require (
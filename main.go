@@ -1,11 +1,15 @@
 package main
 
 import (
+	_ "expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/veggiedefender/protohackers/budgetchat"
 	"github.com/veggiedefender/protohackers/means"
@@ -20,6 +24,83 @@ import (
 var (
 	challengeNum = flag.Int("challenge", -1, "challenge number")
 	addr         = flag.String("addr", "0.0.0.0:8080", "listen address")
+	debugAddr    = flag.String("debug-addr", "", "serve expvar counters on http://<debug-addr>/debug/vars")
+
+	chatWebSocketAddr = flag.String("chat-ws-addr", "", "budgetchat: also serve browser clients over WebSocket on this address")
+	chatIRCAddr       = flag.String("chat-irc-addr", "", "budgetchat: also serve IRC clients on this address")
+	chatBots          = flag.String("chat-bots", "", "budgetchat: comma separated bots to add to the room (dice)")
+
+	chatCommands       = flag.Bool("chat-commands", false, "budgetchat: enable /who and /away")
+	chatAwayAfter      = flag.Duration("chat-away-after", 0, "budgetchat: mark users away after this long without a line (0 disables)")
+	chatIdleDisconnect = flag.Duration("chat-idle-disconnect", 0, "budgetchat: disconnect users after this long without a line (0 disables)")
+
+	chatNameMin      = flag.Int("chat-name-min", 0, "budgetchat: minimum name length in characters")
+	chatNameMax      = flag.Int("chat-name-max", 0, "budgetchat: maximum name length in characters (0 for no limit)")
+	chatNameUnicode  = flag.Bool("chat-name-unicode", false, "budgetchat: allow Unicode letters in names")
+	chatNameNoCase   = flag.Bool("chat-name-nocase", false, "budgetchat: treat names that differ only in case as the same")
+	chatNameReserved = flag.String("chat-name-reserved", "", "budgetchat: comma separated names nobody may use")
+	chatNameRegistry = flag.String("chat-name-registry", "", "budgetchat: file to persist /register name claims in, enables registration")
+
+	chatRosterOrder      = flag.String("chat-roster-order", budgetchat.RosterJoinOrder, "budgetchat: order of the room roster (join or alpha)")
+	chatRosterLineLength = flag.Int("chat-roster-line-length", 0, "budgetchat: wrap the room roster at this many bytes (0 for one line)")
+
+	chatServerID   = flag.String("chat-server-id", "", "budgetchat: name of this server in a federation, enables federation")
+	chatLinkSecret = flag.String("chat-link-secret", "", "budgetchat: secret shared by every server in the federation, required with -chat-server-id")
+	chatLinkAddr   = flag.String("chat-link-addr", "", "budgetchat: accept links from federated servers on this address")
+	chatPeers      = flag.String("chat-peers", "", "budgetchat: comma separated addresses of federated servers to link to")
+
+	chatHistorySize = flag.Int("chat-history-size", 0, "budgetchat: number of recent messages replayed to new members (0 disables replay)")
+	chatHistoryAge  = flag.Duration("chat-history-age", time.Hour, "budgetchat: maximum age of replayed messages (0 for no limit)")
+
+	chatTranscript         = flag.String("chat-transcript", "", "budgetchat: append a JSON lines transcript to this file")
+	chatTranscriptMaxBytes = flag.Int64("chat-transcript-max-bytes", 64<<20, "budgetchat: rotate the transcript once it grows past this size")
+	chatTranscriptFiles    = flag.Int("chat-transcript-files", 5, "budgetchat: number of rotated transcripts to keep")
+
+	chatOperPassword = flag.String("chat-oper-password", "", "budgetchat: password for /oper, enables moderation commands")
+	chatBanFile      = flag.String("chat-bans", "", "budgetchat: file to persist bans in, enables moderation commands")
+	chatFilterWords  = flag.String("chat-filter", "", "budgetchat: comma separated words to filter, enables moderation commands")
+	chatFilterMode   = flag.String("chat-filter-mode", budgetchat.FilterRedact, "budgetchat: redact or reject filtered messages")
+
+	chatMaxLine       = flag.Int("chat-max-line", 0, "budgetchat: maximum line length in bytes (0 for the bufio default)")
+	chatMsgRate       = flag.Float64("chat-msg-rate", 0, "budgetchat: messages per second allowed per client (0 disables)")
+	chatMsgBurst      = flag.Int("chat-msg-burst", 5, "budgetchat: message burst allowed per client")
+	chatByteRate      = flag.Float64("chat-byte-rate", 0, "budgetchat: bytes per second allowed per client (0 disables)")
+	chatByteBurst     = flag.Int("chat-byte-burst", 4096, "budgetchat: byte burst allowed per client")
+	chatMaxViolations = flag.Int("chat-max-violations", 10, "budgetchat: disconnect after this many rate limited messages (0 never)")
+
+	kvWorkers  = flag.Int("kv-workers", 0, "unusualdatabase: goroutines handling requests (0 for one per CPU)")
+	kvVersion  = flag.String("kv-version", "", "unusualdatabase: value of the version key (defaults to one derived from build info)")
+	kvExtended = flag.Bool("kv-extended", false, "unusualdatabase: accept extended requests starting with ! (setex, ttl, cas, setnx, append, incr, incrby, scan)")
+
+	kvNamespaces = flag.String("kv-namespaces", "", "unusualdatabase: comma separated name=client entries confining clients (IPs or CIDR networks) to a namespace")
+
+	kvTCPAddr  = flag.String("kv-tcp-addr", "", "unusualdatabase: also serve the store over line-based TCP on this address")
+	kvHTTPAddr = flag.String("kv-http-addr", "", "unusualdatabase: also serve the store over HTTP on this address")
+
+	kvReplicationAddr   = flag.String("kv-replication-addr", "", "unusualdatabase: accept followers on this address while primary")
+	kvReplicationSecret = flag.String("kv-replication-secret", "", "unusualdatabase: secret shared by a primary and its followers, required to replicate")
+	kvFollow            = flag.String("kv-follow", "", "unusualdatabase: comma separated replication addresses to follow, in order of preference")
+	kvPromoteAfter      = flag.Duration("kv-promote-after", 0, "unusualdatabase: become primary after this long without reaching -kv-follow (0 never)")
+
+	kvMaxKeys  = flag.Int("kv-max-keys", 0, "unusualdatabase: maximum number of keys (0 for no limit)")
+	kvMaxBytes = flag.Int64("kv-max-bytes", 0, "unusualdatabase: maximum total size of keys and values (0 for no limit)")
+	kvEviction = flag.String("kv-eviction", string(unusualdatabase.EvictLRU), "unusualdatabase: what to do when full (lru, lfu or reject)")
+
+	kvDir              = flag.String("kv-dir", "", "unusualdatabase: directory to persist keys in (empty keeps them in memory)")
+	kvFsync            = flag.String("kv-fsync", string(unusualdatabase.SyncAlways), "unusualdatabase: when to fsync the write-ahead log (always, interval or never)")
+	kvFsyncInterval    = flag.Duration("kv-fsync-interval", time.Second, "unusualdatabase: how often to fsync with -kv-fsync=interval")
+	kvSnapshotInterval = flag.Duration("kv-snapshot-interval", 10*time.Minute, "unusualdatabase: how often to snapshot and compact the log (0 disables)")
+	kvCompactBytes     = flag.Int64("kv-compact-bytes", 64<<20, "unusualdatabase: snapshot once the log grows past this size (0 disables)")
+
+	mitmUpstream    = flag.String("mitm-upstream", mobinthemiddle.DefaultUpstream, "mobinthemiddle: address of the chat server to proxy to")
+	mitmDialTimeout = flag.Duration("mitm-dial-timeout", 10*time.Second, "mobinthemiddle: timeout for each attempt to connect upstream (0 for none)")
+	mitmDialRetries = flag.Int("mitm-dial-retries", 0, "mobinthemiddle: times to retry connecting upstream before giving up on a client")
+	mitmRetryDelay  = flag.Duration("mitm-retry-delay", 500*time.Millisecond, "mobinthemiddle: wait before the first retry, doubling after each")
+	mitmRecordDir   = flag.String("mitm-record-dir", "", "mobinthemiddle: record each session, before and after rewriting, to a file in this directory")
+	mitmMaxLine     = flag.Int("mitm-max-line", mobinthemiddle.DefaultMaxLineLength, "mobinthemiddle: end sessions that send a line longer than this many bytes")
+
+	mitmRules     = flag.String("mitm-rules", "", "mobinthemiddle: JSON file of rewrite rules, reloaded on SIGHUP or change (default rewrites Boguscoin addresses)")
+	mitmRulesPoll = flag.Duration("mitm-rules-poll", time.Second, "mobinthemiddle: how often to check -mitm-rules for changes")
 )
 
 type Challenge interface {
@@ -27,15 +108,37 @@ type Challenge interface {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "chatlog" {
+		os.Exit(chatlog(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mitmreplay" {
+		os.Exit(mitmreplay(os.Args[2:]))
+	}
+
 	flag.Parse()
 
+	chat, err := newChatServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kv, err := newKVServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mitm, err := newMITMServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	challenges := map[int]Challenge{
 		0: smoketest.Server{},
 		1: primetime.Server{},
 		2: means.Server{},
-		3: budgetchat.NewServer(),
-		4: unusualdatabase.NewServer(),
-		5: mobinthemiddle.Server{},
+		3: chat,
+		4: kv,
+		5: mitm,
 		6: speeddaemon.Server{},
 	}
 
@@ -51,6 +154,252 @@ func main() {
 		log.Fatalf("invalid challenge %d", *challengeNum)
 	}
 
+	if *debugAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
+
+	if *challengeNum == 3 && *chatWebSocketAddr != "" {
+		log.Printf("serving budgetchat websockets on %s", *chatWebSocketAddr)
+		go chat.ListenWebSocket(*chatWebSocketAddr)
+	}
+
+	if *challengeNum == 3 && *chatIRCAddr != "" {
+		log.Printf("serving budgetchat irc on %s", *chatIRCAddr)
+		go chat.ListenIRC(*chatIRCAddr)
+	}
+
+	if *challengeNum == 3 && chat.Federation != nil {
+		if *chatLinkAddr != "" {
+			log.Printf("accepting budgetchat links on %s", *chatLinkAddr)
+			go chat.Federation.Listen(*chatLinkAddr)
+		}
+		for _, peer := range strings.Split(*chatPeers, ",") {
+			if peer != "" {
+				go chat.Federation.Connect(peer)
+			}
+		}
+	}
+
+	if *challengeNum == 4 && *kvTCPAddr != "" {
+		log.Printf("serving unusualdatabase tcp on %s", *kvTCPAddr)
+		go kv.ListenTCP(*kvTCPAddr)
+	}
+
+	if *challengeNum == 4 && *kvHTTPAddr != "" {
+		log.Printf("serving unusualdatabase http on %s", *kvHTTPAddr)
+		go kv.ListenHTTP(*kvHTTPAddr)
+	}
+
+	if *challengeNum == 4 && *kvReplicationAddr != "" {
+		log.Printf("accepting unusualdatabase followers on %s", *kvReplicationAddr)
+		go kv.ListenReplication(*kvReplicationAddr)
+	}
+
+	if *challengeNum == 4 && *kvFollow != "" {
+		follower := kv.Follow(strings.Split(*kvFollow, ",")...)
+		follower.PromoteAfter = *kvPromoteAfter
+		go follower.Run()
+	}
+
+	if *challengeNum == 5 && *mitmRules != "" {
+		go mitm.WatchRules(*mitmRules, *mitmRulesPoll, nil)
+	}
+
 	log.Printf("serving challenge %d on %s", *challengeNum, *addr)
 	srv.Listen(*addr)
 }
+
+func newChatServer() (*budgetchat.Server, error) {
+	chat := budgetchat.NewServer()
+
+	if *chatHistorySize > 0 {
+		chat.History = budgetchat.NewHistory(*chatHistorySize, *chatHistoryAge)
+	}
+
+	if *chatTranscript != "" {
+		if chat.History != nil {
+			if err := loadChatHistory(chat.History, *chatTranscript); err != nil {
+				return nil, err
+			}
+		}
+
+		transcript, err := budgetchat.OpenTranscript(*chatTranscript, "budgetchat", *chatTranscriptMaxBytes, *chatTranscriptFiles)
+		if err != nil {
+			return nil, err
+		}
+		chat.Transcript = transcript
+	}
+
+	chat.Commands = *chatCommands
+	if *chatAwayAfter > 0 || *chatIdleDisconnect > 0 {
+		chat.Idle = &budgetchat.IdlePolicy{
+			AwayAfter:       *chatAwayAfter,
+			DisconnectAfter: *chatIdleDisconnect,
+		}
+	}
+
+	if *chatNameMin > 0 || *chatNameMax > 0 || *chatNameUnicode || *chatNameNoCase || *chatNameReserved != "" {
+		policy := budgetchat.FlexibleNamePolicy{
+			MinLength:       *chatNameMin,
+			MaxLength:       *chatNameMax,
+			Unicode:         *chatNameUnicode,
+			CaseInsensitive: *chatNameNoCase,
+		}
+		if *chatNameReserved != "" {
+			policy.Reserved = strings.Split(*chatNameReserved, ",")
+		}
+		chat.NamePolicy = policy
+	}
+	if *chatNameRegistry != "" {
+		registry, err := budgetchat.OpenNameRegistry(*chatNameRegistry)
+		if err != nil {
+			return nil, err
+		}
+		chat.Registry = registry
+	}
+
+	switch *chatRosterOrder {
+	case budgetchat.RosterJoinOrder, budgetchat.RosterAlphabetical:
+		chat.RosterOrder = *chatRosterOrder
+	default:
+		return nil, fmt.Errorf("unknown roster order %q", *chatRosterOrder)
+	}
+	chat.RosterLineLength = *chatRosterLineLength
+
+	chat.MaxLineLength = *chatMaxLine
+	if *chatMsgRate > 0 || *chatByteRate > 0 {
+		chat.RateLimit = &budgetchat.RateLimit{
+			MessagesPerSecond: *chatMsgRate,
+			MessageBurst:      *chatMsgBurst,
+			BytesPerSecond:    *chatByteRate,
+			ByteBurst:         *chatByteBurst,
+			MaxViolations:     *chatMaxViolations,
+		}
+	}
+
+	if *chatOperPassword != "" || *chatBanFile != "" || *chatFilterWords != "" {
+		moderation, err := budgetchat.NewModeration(*chatOperPassword, *chatBanFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := moderation.SetFilter(strings.Split(*chatFilterWords, ","), *chatFilterMode); err != nil {
+			return nil, err
+		}
+		chat.Moderation = moderation
+	}
+
+	if *chatServerID != "" {
+		if *chatLinkSecret == "" {
+			return nil, fmt.Errorf("-chat-server-id needs -chat-link-secret")
+		}
+		chat.Federate(*chatServerID, *chatLinkSecret)
+	}
+
+	for _, name := range strings.Split(*chatBots, ",") {
+		var bot budgetchat.Bot
+		switch name {
+		case "":
+			continue
+		case "dice":
+			bot = &budgetchat.DiceBot{}
+		default:
+			return nil, fmt.Errorf("unknown bot %q", name)
+		}
+		if err := chat.AddBot(bot); err != nil {
+			return nil, err
+		}
+	}
+
+	return chat, nil
+}
+
+func newKVServer() (*unusualdatabase.Server, error) {
+	kv := unusualdatabase.NewServer()
+	kv.Workers = *kvWorkers
+	kv.Extended = *kvExtended
+
+	if (*kvReplicationAddr != "" || *kvFollow != "") && *kvReplicationSecret == "" {
+		return nil, fmt.Errorf("replication needs -kv-replication-secret")
+	}
+	kv.ReplicationSecret = *kvReplicationSecret
+	if *kvVersion != "" {
+		kv.Version = *kvVersion
+	}
+	for _, entry := range strings.Split(*kvNamespaces, ",") {
+		if entry == "" {
+			continue
+		}
+		name, client, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("namespace %q is not name=client", entry)
+		}
+		if err := kv.AddNamespace(name, client); err != nil {
+			return nil, err
+		}
+	}
+
+	if *kvDir != "" {
+		store, err := unusualdatabase.OpenStore(unusualdatabase.Durability{
+			Dir:              *kvDir,
+			Sync:             unusualdatabase.SyncPolicy(*kvFsync),
+			SyncInterval:     *kvFsyncInterval,
+			SnapshotInterval: *kvSnapshotInterval,
+			CompactBytes:     *kvCompactBytes,
+		})
+		if err != nil {
+			return nil, err
+		}
+		kv.Store = store
+	}
+
+	switch policy := unusualdatabase.EvictionPolicy(*kvEviction); policy {
+	case unusualdatabase.EvictLRU, unusualdatabase.EvictLFU, unusualdatabase.EvictReject:
+		kv.Store.Limits = unusualdatabase.Limits{
+			MaxKeys:  *kvMaxKeys,
+			MaxBytes: *kvMaxBytes,
+			Policy:   policy,
+		}
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", policy)
+	}
+	return kv, nil
+}
+
+func newMITMServer() (*mobinthemiddle.Server, error) {
+	mitm := mobinthemiddle.NewServer()
+	mitm.Upstream = *mitmUpstream
+	mitm.DialTimeout = *mitmDialTimeout
+	mitm.DialRetries = *mitmDialRetries
+	mitm.RetryDelay = *mitmRetryDelay
+	mitm.MaxLineLength = *mitmMaxLine
+	mitm.RecordDir = *mitmRecordDir
+	if mitm.RecordDir != "" {
+		if err := os.MkdirAll(mitm.RecordDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if *mitmRules != "" {
+		rules, err := mobinthemiddle.LoadRules(*mitmRules)
+		if err != nil {
+			return nil, err
+		}
+		mitm.SetRules(rules)
+	}
+	return mitm, nil
+}
+
+func loadChatHistory(history *budgetchat.History, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return history.LoadTranscript(f)
+}
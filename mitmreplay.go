@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/veggiedefender/protohackers/mobinthemiddle"
+)
+
+// mitmreplay feeds mobinthemiddle session recordings back through a set of
+// rules and shows where they would rewrite lines differently, e.g.
+// `protohackers mitmreplay -rules rules.json sessions/*.jsonl`.
+func mitmreplay(args []string) int {
+	fs := flag.NewFlagSet("mitmreplay", flag.ExitOnError)
+	rulesPath := fs.String("rules", "", "JSON file of rules to replay through (default rewrites Boguscoin addresses)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: protohackers mitmreplay [flags] recording...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	rules := mobinthemiddle.DefaultRules()
+	if *rulesPath != "" {
+		var err error
+		rules, err = mobinthemiddle.LoadRules(*rulesPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Printf("=== %s\n", path)
+		total, changed, err := mobinthemiddle.Replay(f, rules, os.Stdout)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("%d of %d lines rewritten differently\n", changed, total)
+	}
+
+	return 0
+}
@@ -2,91 +2,195 @@ package mobinthemiddle
 
 import (
 	"bufio"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"regexp"
+	"sync/atomic"
+	"time"
 )
 
-type Server struct{}
+const (
+	DefaultUpstream      = "chat.protohackers.com:16963"
+	DefaultMaxLineLength = 64 * 1024
+)
+
+var ErrLineTooLong = errors.New("line too long")
+
+type Server struct {
+	// Upstream is the address of the chat server clients are proxied to.
+	Upstream string
+	// DialTimeout bounds each attempt to connect upstream, or 0 for no limit.
+	DialTimeout time.Duration
+	// DialRetries is how many more times to try connecting upstream after
+	// the first attempt fails.
+	DialRetries int
+	// RetryDelay is how long to wait before the first retry. It doubles after
+	// every retry.
+	RetryDelay time.Duration
+	// MaxLineLength is the longest line passed on, or 0 for
+	// DefaultMaxLineLength. Sessions sending longer lines are ended, since
+	// they could not be rewritten without buffering them whole.
+	MaxLineLength int
+	// RecordDir is a directory to record every session in, one file each, or
+	// empty to record nothing.
+	RecordDir string
+
+	rules    atomic.Pointer[Rules]
+	sessions atomic.Uint64
+}
+
+func NewServer() *Server {
+	s := &Server{
+		Upstream:    DefaultUpstream,
+		DialTimeout: 10 * time.Second,
+		RetryDelay:  500 * time.Millisecond,
+	}
+	s.SetRules(DefaultRules())
+	return s
+}
 
-var BogusCoinAddress = regexp.MustCompile(`(\b)7[a-zA-Z0-9_]{25,34}(\n| )`)
+var BogusCoinAddress = regexp.MustCompile(`(\b)7[a-zA-Z0-9_]{25,34}(\n| |$)`)
 
-func (s Server) Listen(addr string) {
+const TonyAddress = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+func (s *Server) Listen(addr string) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Fatal("tcp server accept error", s.serve(listener))
+}
 
+func (s *Server) serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal("tcp server accept error", err)
+			return err
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// dialUpstream connects to the upstream, retrying with exponential backoff.
+func (s *Server) dialUpstream() (net.Conn, error) {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", s.Upstream, s.DialTimeout)
+		if err == nil || attempt >= s.DialRetries {
+			return conn, err
 		}
 
-		go handleConnection(conn)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
 
-func handleConnection(eyeball net.Conn) {
+func (s *Server) handleConnection(eyeball net.Conn) {
 	defer eyeball.Close()
 
-	origin, err := net.Dial("tcp", "chat.protohackers.com:16963")
+	origin, err := s.dialUpstream()
 	if err != nil {
+		log.Println(err)
 		return
 	}
 	defer origin.Close()
 
-	eyeballChan := chanFromConn(eyeball)
-	originChan := chanFromConn(origin)
+	var rec *Recording
+	if s.RecordDir != "" {
+		rec, err = s.createRecording()
+		if err != nil {
+			log.Println(err)
+		} else {
+			defer rec.Close()
+		}
+	}
 
-	for {
-		select {
-		case msg := <-eyeballChan:
-			if msg == nil {
-				return
-			}
-			if err := intercept(origin, msg); err != nil {
+	// Each direction carries on until its sender is done, so that a client
+	// that has finished sending still gets the rest of the server's replies.
+	// The session ends once both are done, or as soon as either fails.
+	done := make(chan error, 2)
+	go func() { done <- s.proxy(rec, FromEyeball, eyeball, origin) }()
+	go func() { done <- s.proxy(rec, FromOrigin, origin, eyeball) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			if !errors.Is(err, net.ErrClosed) {
 				log.Println(err)
-				return
-			}
-		case msg := <-originChan:
-			if msg == nil {
-				return
-			}
-			if err := intercept(eyeball, msg); err != nil {
-				log.Println(err)
-				return
 			}
+			return
 		}
 	}
 }
 
-func intercept(recipient net.Conn, msg []byte) error {
-	msg = BogusCoinAddress.ReplaceAll(msg, []byte("${1}7YWHMfk9JZe0LM0g1ZauHuiSxhI${2}"))
-
-	_, err := recipient.Write(msg)
-	if err != nil {
-		return err
+// proxy sends lines from src to dst through the rules until src has nothing
+// more to send, and then closes dst for writing. A last line without a newline
+// is sent as it is. Lines are recorded to rec, if it is not nil.
+func (s *Server) proxy(rec *Recording, from Direction, src, dst net.Conn) error {
+	reader := bufio.NewReader(src)
+	for {
+		line, err := readLine(reader, s.maxLineLength())
+		if len(line) > 0 {
+			if err := s.intercept(rec, from, dst, line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return closeWrite(dst)
+		}
+		if err != nil {
+			return err
+		}
 	}
+}
 
-	return nil
+func (s *Server) maxLineLength() int {
+	if s.MaxLineLength > 0 {
+		return s.MaxLineLength
+	}
+	return DefaultMaxLineLength
 }
 
-func chanFromConn(conn net.Conn) chan []byte {
-	c := make(chan []byte)
+// readLine reads up to and including the next newline, or whatever is left if
+// the input ends first. Lines over max bytes fail with ErrLineTooLong rather
+// than being buffered.
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			return nil, ErrLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
 
-	go func() {
-		reader := bufio.NewReader(conn)
-		defer close(c)
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				return
-			}
+// closeWrite tells the other end of conn that nothing more is coming, while
+// still letting it send. Connections that cannot be half closed are closed.
+func closeWrite(conn net.Conn) error {
+	if conn, ok := conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return conn.Close()
+}
 
-			c <- line
+// intercept rewrites a line from one side and sends the result to the other.
+func (s *Server) intercept(rec *Recording, from Direction, recipient net.Conn, msg []byte) error {
+	lines := s.Rules().Apply(from, msg)
+	if rec != nil {
+		if err := rec.write(from, msg, lines); err != nil {
+			log.Println(err)
 		}
-	}()
+	}
 
-	return c
+	for _, line := range lines {
+		if _, err := recipient.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
 }
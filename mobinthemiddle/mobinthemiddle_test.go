@@ -0,0 +1,154 @@
+package mobinthemiddle
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veggiedefender/protohackers/budgetchat"
+)
+
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// startChat runs a budgetchat server to proxy to.
+func startChat(t *testing.T) string {
+	listener := listen(t)
+	go budgetchat.NewServer().Serve(listener)
+	return listener.Addr().String()
+}
+
+func startProxy(t *testing.T, s *Server) string {
+	listener := listen(t)
+	go s.serve(listener)
+	return listener.Addr().String()
+}
+
+type chatClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// join connects to addr and joins the room as name.
+func join(t *testing.T, addr, name string) *chatClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &chatClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.readLine()
+	c.send(name)
+	c.readLine()
+	return c
+}
+
+func (c *chatClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *chatClient) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func TestRewritesBothDirections(t *testing.T) {
+	s := NewServer()
+	s.Upstream = startChat(t)
+	proxy := startProxy(t, s)
+
+	bob := join(t, s.Upstream, "bob")
+	alice := join(t, proxy, "alice")
+	assert.Equal(t, "* alice has entered the room", bob.readLine())
+
+	alice.send("Send to 7F1u3wSD5RbOHQmupo9nx4TnhQ please")
+	assert.Equal(t, "[alice] Send to "+TonyAddress+" please", bob.readLine())
+
+	bob.send("My address is 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T")
+	assert.Equal(t, "[bob] My address is "+TonyAddress, alice.readLine())
+
+	bob.send("Not an address: 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-fmAr")
+	assert.Equal(t, "[bob] Not an address: 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-fmAr", alice.readLine())
+}
+
+func TestRetriesUpstream(t *testing.T) {
+	// Reserve an address for the upstream, which only starts listening after
+	// the proxy has begun dialing it.
+	listener := listen(t)
+	upstream := listener.Addr().String()
+	listener.Close()
+
+	s := NewServer()
+	s.Upstream = upstream
+	s.DialTimeout = time.Second
+	s.DialRetries = 5
+	s.RetryDelay = 50 * time.Millisecond
+	proxy := startProxy(t, s)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	listener, err = net.Listen("tcp", upstream)
+	if err != nil {
+		t.Skip("upstream address was taken:", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go budgetchat.NewServer().Serve(listener)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "Welcome to budgetchat! What shall I call you?\n", line)
+}
+
+func TestGivesUpOnUnreachableUpstream(t *testing.T) {
+	listener := listen(t)
+	upstream := listener.Addr().String()
+	listener.Close()
+
+	s := NewServer()
+	s.Upstream = upstream
+	s.DialRetries = 2
+	s.RetryDelay = 10 * time.Millisecond
+	proxy := startProxy(t, s)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, isTimeout(err), "connection was not closed: %v", err)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
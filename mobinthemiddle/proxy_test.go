@@ -0,0 +1,97 @@
+package mobinthemiddle
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSession connects a client through a proxy to a bare upstream, and
+// returns both ends of the session.
+func startSession(t *testing.T, s *Server) (client, upstream *net.TCPConn) {
+	t.Helper()
+	listener := listen(t)
+	s.Upstream = listener.Addr().String()
+
+	conn, err := net.Dial("tcp", startProxy(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	origin, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { origin.Close() })
+	return conn.(*net.TCPConn), origin.(*net.TCPConn)
+}
+
+// readAll reads from conn until the other end stops sending.
+func readAll(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestHalfClose(t *testing.T) {
+	client, upstream := startSession(t, NewServer())
+
+	client.Write([]byte("hello\n"))
+	assert.Nil(t, client.CloseWrite())
+	assert.Equal(t, "hello\n", readAll(t, upstream))
+
+	// The client is still listening after it has finished sending.
+	upstream.Write([]byte("first\nsecond\n"))
+	upstream.CloseWrite()
+	assert.Equal(t, "first\nsecond\n", readAll(t, client))
+}
+
+func TestTrailingPartialLine(t *testing.T) {
+	client, upstream := startSession(t, NewServer())
+
+	client.Write([]byte("pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T"))
+	client.CloseWrite()
+	assert.Equal(t, "pay "+TonyAddress, readAll(t, upstream))
+
+	upstream.Write([]byte("no newline"))
+	upstream.CloseWrite()
+	assert.Equal(t, "no newline", readAll(t, client))
+}
+
+func TestLongLineEndsSession(t *testing.T) {
+	s := NewServer()
+	s.MaxLineLength = 64
+	client, upstream := startSession(t, s)
+
+	client.Write([]byte(strings.Repeat("x", 64) + "\n"))
+	assert.Equal(t, "", readAll(t, upstream))
+	assert.Equal(t, "", readAll(t, client))
+}
+
+func TestReadLine(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("short\n"+strings.Repeat("x", 40)+"\ntail"), 16)
+
+	line, err := readLine(reader, 32)
+	assert.Nil(t, err)
+	assert.Equal(t, "short\n", string(line))
+
+	_, err = readLine(reader, 32)
+	assert.ErrorIs(t, err, ErrLineTooLong)
+
+	reader = bufio.NewReaderSize(strings.NewReader(strings.Repeat("y", 40)+"\ntail"), 16)
+	line, err = readLine(reader, 41)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("y", 40)+"\n", string(line))
+
+	line, err = readLine(reader, 41)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "tail", string(line))
+}
@@ -0,0 +1,124 @@
+package mobinthemiddle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Record is one line passing through the proxy. Line is what the sender sent,
+// and Sent is what the proxy passed on in its place after rewriting.
+type Record struct {
+	Time time.Time `json:"time"`
+	From Direction `json:"from"`
+	Line string    `json:"line"`
+	Sent []string  `json:"sent"`
+}
+
+// Recording is a JSON lines log of one proxied session.
+type Recording struct {
+	Path string
+
+	file *os.File
+	mu   sync.Mutex
+}
+
+// createRecording starts a recording for a new session in s.RecordDir.
+func (s *Server) createRecording() (*Recording, error) {
+	name := fmt.Sprintf("session-%s-%d.jsonl", time.Now().Format("20060102-150405.000000"), s.sessions.Add(1))
+	path := filepath.Join(s.RecordDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recording{Path: path, file: file}, nil
+}
+
+func (r *Recording) write(from Direction, line []byte, sent [][]byte) error {
+	rec := Record{
+		Time: time.Now(),
+		From: from,
+		Line: string(line),
+		Sent: make([]string, len(sent)),
+	}
+	for i, line := range sent {
+		rec.Sent[i] = string(line)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// One direction can still be winding down after the session has ended.
+	if r.file == nil {
+		return nil
+	}
+	_, err = r.file.Write(data)
+	return err
+}
+
+func (r *Recording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// ReadRecording calls fn for every record in r, stopping at the first error.
+func ReadRecording(r io.Reader, fn func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*DefaultMaxLineLength)
+
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Replay feeds the lines of a recording back through rules, and writes to w
+// every line that rules would rewrite differently from how it was rewritten
+// when it was recorded, as a diff. It returns how many lines there were and
+// how many of them differ.
+func Replay(r io.Reader, rules *Rules, w io.Writer) (total, changed int, err error) {
+	err = ReadRecording(r, func(rec Record) error {
+		total++
+
+		var replayed []string
+		for _, line := range rules.Apply(rec.From, []byte(rec.Line)) {
+			replayed = append(replayed, string(line))
+		}
+		if slices.Equal(replayed, rec.Sent) {
+			return nil
+		}
+		changed++
+
+		fmt.Fprintf(w, "%s %s: %s\n", rec.Time.Format("2006-01-02 15:04:05.000"), rec.From, strings.TrimSuffix(rec.Line, "\n"))
+		for _, line := range rec.Sent {
+			fmt.Fprintf(w, "- %s\n", strings.TrimSuffix(line, "\n"))
+		}
+		for _, line := range replayed {
+			fmt.Fprintf(w, "+ %s\n", strings.TrimSuffix(line, "\n"))
+		}
+		return nil
+	})
+	return total, changed, err
+}
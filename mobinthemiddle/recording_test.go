@@ -0,0 +1,100 @@
+package mobinthemiddle
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	assert.Nil(t, ReadRecording(f, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}))
+	return records
+}
+
+func TestRecordsSessions(t *testing.T) {
+	s := NewServer()
+	s.RecordDir = t.TempDir()
+	client, upstream := startSession(t, s)
+
+	client.Write([]byte("pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T\n"))
+	client.CloseWrite()
+	readAll(t, upstream)
+	upstream.Write([]byte("thanks"))
+	upstream.CloseWrite()
+	readAll(t, client)
+
+	var paths []string
+	assert.Eventually(t, func() bool {
+		paths, _ = filepath.Glob(filepath.Join(s.RecordDir, "session-*.jsonl"))
+		return len(paths) == 1 && len(readRecords(t, paths[0])) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	records := readRecords(t, paths[0])
+	assert.Equal(t, FromEyeball, records[0].From)
+	assert.Equal(t, "pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T\n", records[0].Line)
+	assert.Equal(t, []string{"pay " + TonyAddress + "\n"}, records[0].Sent)
+	assert.WithinDuration(t, time.Now(), records[0].Time, time.Minute)
+
+	assert.Equal(t, FromOrigin, records[1].From)
+	assert.Equal(t, "thanks", records[1].Line)
+	assert.Equal(t, []string{"thanks"}, records[1].Sent)
+}
+
+func TestReplay(t *testing.T) {
+	var recording bytes.Buffer
+	encoder := json.NewEncoder(&recording)
+	rules := DefaultRules()
+	for _, rec := range []Record{
+		{From: FromEyeball, Line: "pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T\n"},
+		{From: FromOrigin, Line: "[bob] hi\n"},
+		{From: FromOrigin, Line: "[bob] buy now\n"},
+	} {
+		rec.Time = time.Now()
+		for _, line := range rules.Apply(rec.From, []byte(rec.Line)) {
+			rec.Sent = append(rec.Sent, string(line))
+		}
+		encoder.Encode(rec)
+	}
+
+	// The same rules rewrite everything the same way.
+	var diff strings.Builder
+	total, changed, err := Replay(bytes.NewReader(recording.Bytes()), rules, &diff)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 0, changed)
+	assert.Empty(t, diff.String())
+
+	rules, err = NewRules([]Rule{
+		{Name: "test-replay-spam", Direction: FromOrigin, Literal: "buy now", Action: ActionDrop},
+	})
+	assert.Nil(t, err)
+	total, changed, err = Replay(bytes.NewReader(recording.Bytes()), rules, &diff)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 2, changed)
+
+	lines := strings.Split(strings.TrimSuffix(diff.String(), "\n"), "\n")
+	assert.Len(t, lines, 5)
+	assert.True(t, strings.HasSuffix(lines[0], " eyeball: pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T"), lines[0])
+	assert.Equal(t, "- pay "+TonyAddress, lines[1])
+	assert.Equal(t, "+ pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T", lines[2])
+	assert.True(t, strings.HasSuffix(lines[3], " origin: [bob] buy now"), lines[3])
+	assert.Equal(t, "- [bob] buy now", lines[4])
+}
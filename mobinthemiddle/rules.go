@@ -0,0 +1,227 @@
+package mobinthemiddle
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+// ruleHits counts the lines each rule has matched, by rule name. Counts carry
+// over when the rules are reloaded.
+var ruleHits = expvar.NewMap("mobinthemiddle_rule_hits")
+
+// Direction is which side of the proxy sent a line.
+type Direction string
+
+const (
+	// FromEyeball is lines from the client, on their way to the chat server.
+	FromEyeball Direction = "eyeball"
+	// FromOrigin is lines from the chat server, on their way to the client.
+	FromOrigin Direction = "origin"
+)
+
+type Action string
+
+const (
+	// ActionReplace replaces every match with Replace, which may refer to
+	// regex groups as ${1}.
+	ActionReplace Action = "replace"
+	// ActionDrop drops matching lines, so no later rule sees them.
+	ActionDrop Action = "drop"
+	// ActionInject sends Inject as a line of its own after matching lines.
+	ActionInject Action = "inject"
+)
+
+// Rule is one step in rewriting the lines passing through the proxy. It
+// matches lines containing Literal, or matching Regex, or every line if
+// neither is set. Lines are matched with their trailing newline, if any.
+type Rule struct {
+	Name string `json:"name"`
+	// Direction limits the rule to lines from one side, or applies it to both
+	// if empty.
+	Direction Direction `json:"direction,omitempty"`
+	// Action is what to do with matching lines, ActionReplace if empty.
+	Action  Action `json:"action,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	Literal string `json:"literal,omitempty"`
+	Replace string `json:"replace,omitempty"`
+	Inject  string `json:"inject,omitempty"`
+
+	regex *regexp.Regexp
+	hits  *expvar.Int
+}
+
+// Rules is an ordered list of rules. Each line goes through every rule that
+// applies to its direction in turn, each seeing the line as the ones before
+// it left it.
+type Rules struct {
+	rules []*Rule
+}
+
+// DefaultRules replaces Boguscoin addresses in both directions with Tony's.
+func DefaultRules() *Rules {
+	rules, err := NewRules([]Rule{{
+		Name:    "boguscoin",
+		Regex:   BogusCoinAddress.String(),
+		Replace: "${1}" + TonyAddress + "${2}",
+	}})
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// NewRules checks and compiles rules. Unnamed rules are named after their
+// position, counting from 1.
+func NewRules(rules []Rule) (*Rules, error) {
+	compiled := &Rules{}
+	for i, rule := range rules {
+		rule := rule
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		switch rule.Direction {
+		case "", FromEyeball, FromOrigin:
+		default:
+			return nil, fmt.Errorf("rule %s: unknown direction %q", rule.Name, rule.Direction)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = ActionReplace
+		case ActionReplace, ActionDrop:
+		case ActionInject:
+			if rule.Inject == "" {
+				return nil, fmt.Errorf("rule %s: nothing to inject", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+
+		switch {
+		case rule.Regex != "" && rule.Literal != "":
+			return nil, fmt.Errorf("rule %s: has both a regex and a literal", rule.Name)
+		case rule.Action == ActionReplace && rule.Regex == "" && rule.Literal == "":
+			return nil, fmt.Errorf("rule %s: nothing to replace", rule.Name)
+		case rule.Regex != "":
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.regex = regex
+		}
+
+		if hits, ok := ruleHits.Get(rule.Name).(*expvar.Int); ok {
+			rule.hits = hits
+		} else {
+			rule.hits = new(expvar.Int)
+			ruleHits.Set(rule.Name, rule.hits)
+		}
+		compiled.rules = append(compiled.rules, &rule)
+	}
+	return compiled, nil
+}
+
+// LoadRules reads rules from a JSON file holding a list of Rule.
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewRules(rules)
+}
+
+func (r *Rule) matches(line []byte) bool {
+	switch {
+	case r.regex != nil:
+		return r.regex.Match(line)
+	case r.Literal != "":
+		return bytes.Contains(line, []byte(r.Literal))
+	}
+	return true
+}
+
+// Apply runs a line from the given side through the rules and returns the
+// lines to send on in its place.
+func (r *Rules) Apply(from Direction, line []byte) [][]byte {
+	var injected [][]byte
+	for _, rule := range r.rules {
+		if rule.Direction != "" && rule.Direction != from {
+			continue
+		}
+		if !rule.matches(line) {
+			continue
+		}
+		rule.hits.Add(1)
+
+		switch rule.Action {
+		case ActionReplace:
+			if rule.regex != nil {
+				line = rule.regex.ReplaceAll(line, []byte(rule.Replace))
+			} else {
+				line = bytes.ReplaceAll(line, []byte(rule.Literal), []byte(rule.Replace))
+			}
+		case ActionDrop:
+			return injected
+		case ActionInject:
+			injected = append(injected, []byte(rule.Inject+"\n"))
+		}
+	}
+	return append([][]byte{line}, injected...)
+}
+
+// SetRules replaces the rules applied to lines from now on.
+func (s *Server) SetRules(rules *Rules) {
+	s.rules.Store(rules)
+}
+
+func (s *Server) Rules() *Rules {
+	return s.rules.Load()
+}
+
+// WatchRules reloads the rules from path whenever the process receives SIGHUP
+// or, checking every interval, the file changes. Rules that fail to load are
+// logged and the ones in use are kept. It returns once stop is closed.
+func (s *Server) WatchRules(path string, interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(path)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+		}
+
+		last, _ = os.Stat(path)
+		rules, err := LoadRules(path)
+		if err != nil {
+			log.Println("mobinthemiddle: keeping the old rules:", err)
+			continue
+		}
+		s.SetRules(rules)
+		log.Printf("mobinthemiddle: loaded %d rules from %s", len(rules.rules), path)
+	}
+}
@@ -0,0 +1,111 @@
+package mobinthemiddle
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apply(rules *Rules, from Direction, line string) []string {
+	var out []string
+	for _, line := range rules.Apply(from, []byte(line+"\n")) {
+		out = append(out, strings.TrimSuffix(string(line), "\n"))
+	}
+	return out
+}
+
+func hits(name string) int64 {
+	if hits, ok := ruleHits.Get(name).(*expvar.Int); ok {
+		return hits.Value()
+	}
+	return 0
+}
+
+func TestRules(t *testing.T) {
+	rules, err := NewRules([]Rule{
+		{Name: "test-secret", Literal: "secret", Replace: "[redacted]"},
+		{Name: "test-shout", Direction: FromEyeball, Regex: `!+`, Replace: "."},
+		{Name: "test-spam", Direction: FromOrigin, Regex: `^\[\w+\] buy now`, Action: ActionDrop},
+		{Name: "test-welcome", Direction: FromOrigin, Literal: "has entered the room", Action: ActionInject, Inject: "[tony] welcome!"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		From     Direction
+		Line     string
+		Expected []string
+	}{
+		{From: FromEyeball, Line: "my secret is out!!", Expected: []string{"my [redacted] is out."}},
+		{From: FromOrigin, Line: "[bob] hi!", Expected: []string{"[bob] hi!"}},
+		{From: FromOrigin, Line: "[bob] buy now secret", Expected: nil},
+		{From: FromEyeball, Line: "[bob] buy now", Expected: []string{"[bob] buy now"}},
+		{From: FromOrigin, Line: "* alice has entered the room", Expected: []string{"* alice has entered the room", "[tony] welcome!"}},
+	}
+
+	secretHits, spamHits := hits("test-secret"), hits("test-spam")
+	for _, test := range tests {
+		assert.Equal(t, test.Expected, apply(rules, test.From, test.Line), test.Line)
+	}
+	assert.Equal(t, secretHits+2, hits("test-secret"))
+	assert.Equal(t, spamHits+1, hits("test-spam"))
+}
+
+func TestDefaultRules(t *testing.T) {
+	rules := DefaultRules()
+	assert.Equal(t, []string{"pay " + TonyAddress}, apply(rules, FromOrigin, "pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T"))
+	assert.Equal(t, []string{"pay " + TonyAddress + " now"}, apply(rules, FromEyeball, "pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T now"))
+}
+
+func TestNewRulesRejectsInvalid(t *testing.T) {
+	for _, rule := range []Rule{
+		{Direction: "sideways", Literal: "a"},
+		{Action: "explode", Literal: "a"},
+		{Regex: "(", Replace: "a"},
+		{Regex: "a", Literal: "a"},
+		{Action: ActionReplace},
+		{Action: ActionInject, Literal: "a"},
+	} {
+		_, err := NewRules([]Rule{rule})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestWatchRulesReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(rules string) {
+		if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"name": "test-reload", "literal": "a", "replace": "b"}]`)
+
+	s := NewServer()
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRules(rules)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.WatchRules(path, 10*time.Millisecond, stop)
+
+	assert.Equal(t, []string{"b"}, apply(s.Rules(), FromEyeball, "a"))
+
+	// Rules that do not load leave the old ones in place.
+	write(`[{"name": "test-reload", "literal": "a", "replace": "b"`)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"b"}, apply(s.Rules(), FromEyeball, "a"))
+
+	write(`[{"name": "test-reload", "literal": "a", "replace": "changed"}]`)
+	assert.Eventually(t, func() bool {
+		return apply(s.Rules(), FromEyeball, "a")[0] == "changed"
+	}, time.Second, 10*time.Millisecond)
+}
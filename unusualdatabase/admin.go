@@ -0,0 +1,79 @@
+package unusualdatabase
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+const baseVersion = "jesse's cool kv database 1.0"
+
+// adminKeys are answered by the server instead of the store. Writes to them
+// are ignored, just like the spec requires for "version".
+var adminKeys = map[string]func(s *Server) string{
+	"version": func(s *Server) string {
+		return s.Version
+	},
+	"_keys": func(s *Server) string {
+		return strconv.Itoa(s.Store.Len())
+	},
+	"_bytes": func(s *Server) string {
+		return strconv.FormatInt(s.Store.Bytes(), 10)
+	},
+	"_uptime": func(s *Server) string {
+		return time.Since(s.started).Truncate(time.Second).String()
+	},
+	"_memory": func(s *Server) string {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return strconv.FormatUint(stats.HeapAlloc, 10)
+	},
+	"_evictions": func(s *Server) string {
+		return evictions.String()
+	},
+	"_role": func(s *Server) string {
+		if s.Store.ReadOnly() {
+			return "follower"
+		}
+		return "primary"
+	},
+}
+
+// isReadOnly reports whether writes to key are ignored.
+func isReadOnly(key string) bool {
+	_, ok := adminKeys[key]
+	return ok
+}
+
+// defaultVersion tags baseVersion with the module version or VCS revision the
+// binary was built from, if known.
+func defaultVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return baseVersion
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return baseVersion + " " + info.Main.Version
+	}
+
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return baseVersion
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return baseVersion + " " + revision
+}
@@ -0,0 +1,44 @@
+package unusualdatabase
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminKeys(t *testing.T) {
+	s := NewServer()
+	s.Version = "test 2.0"
+	s.Extended = true
+	s.started = time.Now().Add(-time.Minute)
+	conn := dial(t, startServer(t, s))
+
+	conn.Write([]byte("foo=bar"))
+	conn.Write([]byte("_keys=100"))
+	conn.Write([]byte("!setex 10 _role=nope"))
+
+	assert.Equal(t, "version=test 2.0", roundTrip(t, conn, "version"))
+	assert.Equal(t, "_keys=1", roundTrip(t, conn, "_keys"))
+	assert.Equal(t, "_bytes=6", roundTrip(t, conn, "_bytes"))
+	assert.Equal(t, "_uptime=1m0s", roundTrip(t, conn, "_uptime"))
+	assert.Equal(t, "_role=primary", roundTrip(t, conn, "_role"))
+	assert.Equal(t, "!ttl _keys=-1", roundTrip(t, conn, "!ttl _keys"))
+
+	memory := strings.TrimPrefix(roundTrip(t, conn, "_memory"), "_memory=")
+	bytes, err := strconv.ParseUint(memory, 10, 64)
+	assert.Nil(t, err)
+	assert.Greater(t, bytes, uint64(0))
+
+	_, stored := s.Store.Get("_keys")
+	assert.False(t, stored, "writes to admin keys never reach the store")
+
+	s.Store.SetReadOnly(true)
+	assert.Equal(t, "_role=follower", roundTrip(t, conn, "_role"))
+}
+
+func TestDefaultVersion(t *testing.T) {
+	assert.True(t, strings.HasPrefix(defaultVersion(), baseVersion))
+}
@@ -0,0 +1,347 @@
+package unusualdatabase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Durability configures where and how a Store persists its contents. Every
+// write is appended to a log before it is applied. The log is periodically
+// folded into a snapshot and truncated, either every SnapshotInterval or once
+// it grows past CompactBytes.
+type Durability struct {
+	Dir              string
+	Sync             SyncPolicy
+	SyncInterval     time.Duration
+	SnapshotInterval time.Duration
+	CompactBytes     int64
+}
+
+type durableState struct {
+	opts    Durability
+	wal     *writeAheadLog
+	compact chan struct{}
+	mu      sync.Mutex
+}
+
+// OpenStore loads the store persisted in opts.Dir, recovering whatever made it
+// to disk before a crash, and keeps it persisted from then on.
+func OpenStore(opts Durability) (*Store, error) {
+	switch opts.Sync {
+	case "":
+		opts.Sync = SyncAlways
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q", opts.Sync)
+	}
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	st := NewStore()
+	next, err := st.recover(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := createWAL(opts.Dir, next, opts.Sync)
+	if err != nil {
+		return nil, err
+	}
+
+	st.durable = &durableState{
+		opts:    opts,
+		wal:     wal,
+		compact: make(chan struct{}, 1),
+	}
+	if opts.Sync == SyncInterval {
+		go wal.syncEvery(opts.SyncInterval, st.stop)
+	}
+	go st.compactLoop()
+
+	return st, nil
+}
+
+// listGenerations returns the generations of files in dir named prefix.N, in
+// ascending order.
+func listGenerations(dir, prefix string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var gens []uint64
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix+".") {
+			continue
+		}
+		gen, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), prefix+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] < gens[j] })
+	return gens, nil
+}
+
+// recover loads the newest snapshot and replays every log written since. A
+// torn record at the end of the newest log is what a crash mid-write leaves
+// behind, so it is truncated away; damage anywhere else is an error. It
+// returns the generation the next log should use.
+func (st *Store) recover(dir string) (uint64, error) {
+	// A snapshot that was still being written when the process died.
+	stale, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	for _, path := range stale {
+		os.Remove(path)
+	}
+
+	snapshots, err := listGenerations(dir, "snapshot")
+	if err != nil {
+		return 0, err
+	}
+	wals, err := listGenerations(dir, "wal")
+	if err != nil {
+		return 0, err
+	}
+
+	var next uint64
+	if len(snapshots) > 0 {
+		next = snapshots[len(snapshots)-1]
+		data, err := os.ReadFile(snapshotPath(dir, next))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := readRecords(bytes.NewReader(data), st.apply); err != nil {
+			return 0, fmt.Errorf("snapshot.%d: %w", next, err)
+		}
+	}
+
+	for i, gen := range wals {
+		if gen < next {
+			continue
+		}
+
+		file, err := os.OpenFile(walPath(dir, gen), os.O_RDWR, 0)
+		if err != nil {
+			return 0, err
+		}
+		good, err := readRecords(file, st.apply)
+		if errors.Is(err, errCorruptRecord) && i == len(wals)-1 {
+			log.Printf("wal.%d: truncating torn record at offset %d", gen, good)
+			err = file.Truncate(good)
+			if err == nil {
+				err = file.Sync()
+			}
+		}
+		file.Close()
+		if err != nil {
+			return 0, fmt.Errorf("wal.%d: %w", gen, err)
+		}
+		next = gen + 1
+	}
+
+	return next, nil
+}
+
+// encodeEntry turns an entry into a log record, or a deletion if e is nil.
+// Entries with a TTL store the absolute expiry time, as Unix nanoseconds, in
+// front of the value.
+func encodeEntry(key string, e *entry) []byte {
+	if e == nil {
+		return encodeRecord(opDelete, key, "")
+	}
+	if e.expires.IsZero() {
+		return encodeRecord(opSet, key, e.val)
+	}
+	var expires [8]byte
+	binary.BigEndian.PutUint64(expires[:], uint64(e.expires.UnixNano()))
+	return encodeRecord(opSetExpiring, key, string(expires[:])+e.val)
+}
+
+// decodeEntry is the inverse of encodeEntry. It returns a nil entry for
+// deletions and for entries that have already expired, and false for records
+// that do not describe an entry.
+func decodeEntry(op byte, val string) (*entry, bool) {
+	switch op {
+	case opSet:
+		return newEntry(val, time.Time{}), true
+	case opSetExpiring:
+		if len(val) < 8 {
+			return nil, false
+		}
+		e := newEntry(val[8:], time.Unix(0, int64(binary.BigEndian.Uint64([]byte(val[:8])))))
+		if e.expired(time.Now()) {
+			return nil, true
+		}
+		return e, true
+	case opDelete:
+		return nil, true
+	}
+	return nil, false
+}
+
+// apply replays a record without logging it again.
+func (st *Store) apply(op byte, key, val string) {
+	e, ok := decodeEntry(op, val)
+	if !ok {
+		return
+	}
+	st.replaceLocked(st.shard(key), key, e)
+	if e != nil && !e.expires.IsZero() {
+		st.startExpiry()
+	}
+}
+
+// logWrite appends a write, or a deletion if e is nil, to the log if the store
+// is durable, and sends it to any followers. The caller must hold the lock on
+// the key's shard so that the log, the followers and the map agree on the
+// order of writes to each key.
+func (st *Store) logWrite(key string, e *entry) error {
+	if st.durable == nil && !st.replicating() {
+		return nil
+	}
+	record := encodeEntry(key, e)
+
+	if d := st.durable; d != nil {
+		size, err := d.wal.append(record)
+		if err != nil {
+			return err
+		}
+		if d.opts.CompactBytes > 0 && size > d.opts.CompactBytes {
+			select {
+			case d.compact <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	st.publish(record)
+	return nil
+}
+
+func (st *Store) compactLoop() {
+	d := st.durable
+
+	var tick <-chan time.Time
+	if d.opts.SnapshotInterval > 0 {
+		ticker := time.NewTicker(d.opts.SnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-st.stop:
+			return
+		case <-tick:
+		case <-d.compact:
+		}
+		if err := st.Snapshot(); err != nil {
+			log.Println("snapshot:", err)
+		}
+	}
+}
+
+// Snapshot writes the whole store to disk and deletes the logs it replaces.
+func (st *Store) Snapshot() error {
+	d := st.durable
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Everything written before the rotation is in the old logs and will be in
+	// the snapshot. Writes racing with the copy below may end up in both the
+	// snapshot and the new log, which is harmless because replaying them
+	// again leaves the same value.
+	gen, err := d.wal.rotate()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.kv {
+			buf.Write(encodeEntry(key, e))
+		}
+		sh.mu.RUnlock()
+	}
+
+	if err := writeFileSynced(snapshotPath(d.opts.Dir, gen), buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{"snapshot", "wal"} {
+		gens, err := listGenerations(d.opts.Dir, prefix)
+		if err != nil {
+			return err
+		}
+		for _, old := range gens {
+			if old < gen {
+				os.Remove(filepath.Join(d.opts.Dir, fmt.Sprintf("%s.%d", prefix, old)))
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops background work and flushes the log, if any. The store must not
+// be written to afterwards.
+func (st *Store) Close() error {
+	st.stopOnce.Do(func() { close(st.stop) })
+
+	d := st.durable
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.wal.close()
+}
+
+// writeFileSynced atomically replaces path with data, making sure both the
+// contents and the rename are on disk before returning.
+func writeFileSynced(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
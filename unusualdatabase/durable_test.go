@@ -0,0 +1,220 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openStore(t *testing.T, opts Durability) *Store {
+	t.Helper()
+	st, err := OpenStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func assertKeys(t *testing.T, st *Store, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		val, ok := st.Get(fmt.Sprintf("key%d", i))
+		if !assert.True(t, ok, "key%d is missing", i) {
+			return
+		}
+		assert.Equal(t, strconv.Itoa(i), val)
+	}
+}
+
+func TestStoreSurvivesRestart(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		t.Run(string(policy), func(t *testing.T) {
+			opts := Durability{Dir: t.TempDir(), Sync: policy}
+
+			st := openStore(t, opts)
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, st.Set(fmt.Sprintf("key%d", i), strconv.Itoa(i)))
+			}
+			assert.Nil(t, st.Set("key0", "overwritten"))
+			assert.Nil(t, st.Close())
+
+			st = openStore(t, opts)
+			assertKeys(t, st, 1, 100)
+			val, _ := st.Get("key0")
+			assert.Equal(t, "overwritten", val)
+		})
+	}
+}
+
+func TestSnapshotCompactsLog(t *testing.T) {
+	opts := Durability{Dir: t.TempDir()}
+
+	st := openStore(t, opts)
+	for i := 0; i < 50; i++ {
+		st.Set(fmt.Sprintf("key%d", i), strconv.Itoa(i))
+	}
+	assert.Nil(t, st.Snapshot())
+	for i := 50; i < 100; i++ {
+		st.Set(fmt.Sprintf("key%d", i), strconv.Itoa(i))
+	}
+	assert.Nil(t, st.Snapshot())
+	st.Set("key100", "100")
+	assert.Nil(t, st.Close())
+
+	snapshots, _ := listGenerations(opts.Dir, "snapshot")
+	wals, _ := listGenerations(opts.Dir, "wal")
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, snapshots, wals)
+
+	st = openStore(t, opts)
+	assertKeys(t, st, 0, 101)
+}
+
+func TestCompactBytesTriggersSnapshot(t *testing.T) {
+	opts := Durability{Dir: t.TempDir(), CompactBytes: 1024}
+
+	st := openStore(t, opts)
+	for i := 0; i < 200; i++ {
+		st.Set("key", strconv.Itoa(i))
+	}
+	// Snapshots are taken in the background.
+	assert.Eventually(t, func() bool {
+		snapshots, _ := listGenerations(opts.Dir, "snapshot")
+		return len(snapshots) > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, st.Close())
+
+	st = openStore(t, opts)
+	val, _ := st.Get("key")
+	assert.Equal(t, "199", val)
+}
+
+func TestRecoverTornWrite(t *testing.T) {
+	opts := Durability{Dir: t.TempDir()}
+
+	st := openStore(t, opts)
+	for i := 0; i < 10; i++ {
+		st.Set(fmt.Sprintf("key%d", i), strconv.Itoa(i))
+	}
+	assert.Nil(t, st.Close())
+
+	// Cut the last record in half, as if the process died while writing it.
+	path := walPath(opts.Dir, 0)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+
+	st = openStore(t, opts)
+	assertKeys(t, st, 0, 9)
+	_, ok := st.Get("key9")
+	assert.False(t, ok)
+
+	// The torn tail is gone, so writes after recovery are not lost behind it.
+	st.Set("key9", "9")
+	assert.Nil(t, st.Close())
+
+	st = openStore(t, opts)
+	assertKeys(t, st, 0, 10)
+}
+
+func TestRecoverRejectsCorruptHistory(t *testing.T) {
+	opts := Durability{Dir: t.TempDir()}
+
+	st := openStore(t, opts)
+	st.Set("key0", "0")
+	assert.Nil(t, st.Close())
+	st = openStore(t, opts)
+	st.Set("key1", "1")
+	assert.Nil(t, st.Close())
+
+	// Only the newest log can have been cut short by a crash.
+	assert.Nil(t, os.WriteFile(walPath(opts.Dir, 0), []byte("garbage"), 0o644))
+	_, err := OpenStore(opts)
+	assert.ErrorIs(t, err, errCorruptRecord)
+}
+
+// TestCrashWriter is run in a child process by TestRecoverAfterKill. It writes
+// keys in order forever, printing each one once Set has returned.
+func TestCrashWriter(t *testing.T) {
+	dir := os.Getenv("UNUSUALDATABASE_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only runs as a child of TestRecoverAfterKill")
+	}
+
+	st, err := OpenStore(Durability{Dir: dir, Sync: SyncAlways, CompactBytes: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if err := st.Set(fmt.Sprintf("key%d", i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Println(i)
+	}
+}
+
+func TestRecoverAfterKill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a child process")
+	}
+
+	dir := t.TempDir()
+	for round := 0; round < 3; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCrashWriter$")
+		cmd.Env = append(os.Environ(), "UNUSUALDATABASE_CRASH_DIR="+dir)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		acked := -1
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() && acked < 500*(round+1) {
+			if i, err := strconv.Atoi(scanner.Text()); err == nil {
+				acked = i
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		st, err := OpenStore(Durability{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every acknowledged write survived, and nothing after a lost write did.
+		assertKeys(t, st, 0, acked+1)
+		recovered := st.Len()
+		assertKeys(t, st, 0, recovered)
+		assert.Nil(t, st.Close())
+	}
+}
+
+func TestTTLSurvivesRestart(t *testing.T) {
+	opts := Durability{Dir: t.TempDir()}
+
+	st := openStore(t, opts)
+	st.SetWithTTL("long", "x", time.Hour)
+	st.SetWithTTL("brief", "x", 10*time.Millisecond)
+	assert.Nil(t, st.Snapshot())
+	st.SetWithTTL("logged", "x", time.Hour)
+	assert.Nil(t, st.Close())
+
+	time.Sleep(20 * time.Millisecond)
+	st = openStore(t, opts)
+	for _, key := range []string{"long", "logged"} {
+		expires, ok := st.Expiry(key)
+		assert.True(t, ok, key)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute, key)
+	}
+	assert.Equal(t, 2, st.Len())
+}
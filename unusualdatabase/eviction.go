@@ -0,0 +1,197 @@
+package unusualdatabase
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	evictions       = expvar.NewInt("unusualdatabase_evictions")
+	rejectedInserts = expvar.NewInt("unusualdatabase_rejected_inserts")
+)
+
+var ErrStoreFull = errors.New("store is full")
+
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the key that was read or written least recently.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the key that was read or written least often, with
+	// counts halving for every lfuDecay a key goes untouched.
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictReject refuses inserts that would go over the limits instead.
+	EvictReject EvictionPolicy = "reject"
+)
+
+// Limits bounds the number of keys and the total size of keys and values in
+// a Store. A zero limit is no limit. Eviction is approximate: victims are the
+// worst of a random sample of keys rather than the worst overall, the same
+// trade-off Redis makes.
+type Limits struct {
+	MaxKeys  int
+	MaxBytes int64
+	Policy   EvictionPolicy
+}
+
+const (
+	evictionShardSamples = 8
+	evictionKeySamples   = 5
+	lfuDecay             = time.Minute
+)
+
+func (l Limits) enabled() bool {
+	return l.MaxKeys > 0 || l.MaxBytes > 0
+}
+
+func (st *Store) overLimits(keys, bytes int64) bool {
+	return (st.Limits.MaxKeys > 0 && keys > int64(st.Limits.MaxKeys)) ||
+		(st.Limits.MaxBytes > 0 && bytes > st.Limits.MaxBytes)
+}
+
+// admit decides whether e may replace old under key. A value that could never
+// fit is always refused; otherwise only EvictReject refuses anything.
+func (st *Store) admit(key string, old, e *entry) bool {
+	if !st.Limits.enabled() {
+		return true
+	}
+
+	size := entrySize(key, e)
+	if st.Limits.MaxBytes > 0 && size > st.Limits.MaxBytes {
+		return false
+	}
+	if st.Limits.Policy != EvictReject {
+		return true
+	}
+
+	keys, bytes := st.keys.Load()+1, st.bytes.Load()+size
+	if old != nil {
+		keys--
+		bytes -= entrySize(key, old)
+	}
+	return !st.overLimits(keys, bytes)
+}
+
+// decayedHits is e's hit count after halving it for every lfuDecay since it
+// was last touched.
+func decayedHits(e *entry, now int64) uint32 {
+	periods := (now - e.lastAccess.Load()) / int64(lfuDecay)
+	if periods >= 32 {
+		return 0
+	}
+	return e.hits.Load() >> periods
+}
+
+// touch records a use of e. Concurrent touches may lose updates, which only
+// makes eviction slightly less exact.
+func (st *Store) touch(e *entry) {
+	if !st.Limits.enabled() {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	if st.Limits.Policy == EvictLFU {
+		if hits := decayedHits(e, now); hits < math.MaxUint32 {
+			e.hits.Store(hits + 1)
+		}
+	}
+	e.lastAccess.Store(now)
+}
+
+type evictionCandidate struct {
+	shard *shard
+	key   string
+	entry *entry
+	hits  int64
+	age   int64
+}
+
+func (c evictionCandidate) worseThan(other evictionCandidate) bool {
+	if c.hits != other.hits {
+		return c.hits < other.hits
+	}
+	return c.age < other.age
+}
+
+// pickVictim samples keys from a few shards and returns the one that should
+// be evicted first, never choosing keep.
+func (st *Store) pickVictim(keep string) (evictionCandidate, bool) {
+	now := time.Now()
+	var best evictionCandidate
+	found := false
+
+	start := rand.Intn(storeShards)
+	sampled := 0
+	for i := 0; i < storeShards && sampled < evictionShardSamples; i++ {
+		sh := &st.shards[(start+i)%storeShards]
+
+		sh.mu.RLock()
+		n := 0
+		for key, e := range sh.kv {
+			if key == keep {
+				continue
+			}
+
+			c := evictionCandidate{shard: sh, key: key, entry: e, age: e.lastAccess.Load()}
+			switch {
+			case e.expired(now):
+				c.hits = -1
+			case st.Limits.Policy == EvictLFU:
+				c.hits = int64(decayedHits(e, now.UnixNano()))
+			}
+			if !found || c.worseThan(best) {
+				best = c
+				found = true
+			}
+
+			n++
+			if n == evictionKeySamples {
+				break
+			}
+		}
+		sh.mu.RUnlock()
+
+		if n > 0 {
+			sampled++
+		}
+	}
+
+	return best, found
+}
+
+// evict removes keys until the store is back within its limits, sparing the
+// key that was just written.
+func (st *Store) evict(keep string) {
+	if !st.Limits.enabled() || st.Limits.Policy == EvictReject {
+		return
+	}
+
+	st.evictMu.Lock()
+	defer st.evictMu.Unlock()
+
+	for st.overLimits(st.keys.Load(), st.bytes.Load()) {
+		victim, ok := st.pickVictim(keep)
+		if !ok {
+			return
+		}
+
+		sh := victim.shard
+		sh.mu.Lock()
+		if sh.kv[victim.key] == victim.entry {
+			if err := st.logWrite(victim.key, nil); err != nil {
+				sh.mu.Unlock()
+				log.Println("evict:", err)
+				return
+			}
+			st.replaceLocked(sh, victim.key, nil)
+			if victim.hits >= 0 {
+				evictions.Add(1)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
@@ -0,0 +1,95 @@
+package unusualdatabase
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fill(st *Store, from, to int) {
+	for i := from; i < to; i++ {
+		st.Set(fmt.Sprintf("key%d", i), "value")
+	}
+}
+
+func survivors(st *Store, from, to int) int {
+	n := 0
+	for i := from; i < to; i++ {
+		if _, ok := st.Get(fmt.Sprintf("key%d", i)); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEvictLRU(t *testing.T) {
+	st := NewStore()
+	st.Limits = Limits{MaxKeys: 200, Policy: EvictLRU}
+
+	fill(st, 0, 200)
+	survivors(st, 0, 100)
+	before := evictions.Value()
+	fill(st, 200, 300)
+
+	assert.Equal(t, 200, st.Len())
+	assert.Equal(t, int64(100), evictions.Value()-before)
+	assert.Equal(t, 100, survivors(st, 200, 300), "new keys are never evicted")
+	assert.Greater(t, survivors(st, 0, 100), 80, "recently read keys mostly survive")
+}
+
+func TestEvictLFU(t *testing.T) {
+	st := NewStore()
+	st.Limits = Limits{MaxKeys: 200, Policy: EvictLFU}
+
+	fill(st, 0, 200)
+	for i := 0; i < 5; i++ {
+		survivors(st, 0, 100)
+	}
+	// Reading the cold keys once more makes them the most recent, but they
+	// are still the least frequently used.
+	survivors(st, 100, 200)
+	fill(st, 200, 250)
+
+	assert.Equal(t, 200, st.Len())
+	assert.Greater(t, survivors(st, 0, 100), 90, "frequently read keys mostly survive")
+}
+
+func TestEvictByBytes(t *testing.T) {
+	st := NewStore()
+	st.Limits = Limits{MaxBytes: 100, Policy: EvictLRU}
+
+	fill(st, 10, 30)
+	assert.LessOrEqual(t, st.Bytes(), int64(100))
+	assert.Equal(t, int64(st.Len()*len("key10value")), st.Bytes())
+
+	assert.Equal(t, ErrStoreFull, st.Set("huge", string(make([]byte, 100))))
+}
+
+func TestRejectWhenFull(t *testing.T) {
+	st := NewStore()
+	st.Limits = Limits{MaxKeys: 2, MaxBytes: 20, Policy: EvictReject}
+
+	before := rejectedInserts.Value()
+	assert.Nil(t, st.Set("a", "1"))
+	assert.Nil(t, st.Set("b", "2"))
+	assert.Equal(t, ErrStoreFull, st.Set("c", "3"))
+	assert.Nil(t, st.Set("a", "overwrite"), "overwriting does not add a key")
+	assert.Equal(t, ErrStoreFull, st.Set("b", "much too long"))
+	assert.Equal(t, int64(2), rejectedInserts.Value()-before)
+
+	val, _ := st.Get("b")
+	assert.Equal(t, "2", val)
+}
+
+func TestEvictionsArePersisted(t *testing.T) {
+	opts := Durability{Dir: t.TempDir()}
+
+	st := openStore(t, opts)
+	st.Limits = Limits{MaxKeys: 10, Policy: EvictLRU}
+	fill(st, 0, 50)
+	assert.Nil(t, st.Close())
+
+	st = openStore(t, opts)
+	assert.Equal(t, 10, st.Len())
+}
@@ -0,0 +1,301 @@
+package unusualdatabase
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Extended requests start with extendedPrefix and are only understood when
+// Server.Extended is set, since otherwise they are ordinary keys. They look
+// like
+//
+//	!<command> [<arg> ...] <key>[=<value>]
+//
+// where each command takes a fixed number of space separated arguments, and
+// anything after them is the key and value just as in a plain request.
+// Arguments that may need to contain spaces are percent-encoded. Requests that
+// return something are answered with the request, minus any value, followed
+// by "=" and the result. Malformed requests are ignored.
+const extendedPrefix = "!"
+
+type extendedRequest struct {
+	// ns is the namespace of the client that sent the request.
+	ns      string
+	command string
+	args    []string
+	key     string
+	val     string
+	hasVal  bool
+}
+
+type extendedCommand struct {
+	args int
+	run  func(s *Server, req extendedRequest) (result string, reply bool, err error)
+}
+
+var extendedCommands = map[string]extendedCommand{
+	"setex":  {args: 1, run: cmdSetEx},
+	"ttl":    {run: cmdTTL},
+	"cas":    {args: 1, run: cmdCAS},
+	"setnx":  {run: cmdSetNX},
+	"append": {run: cmdAppend},
+	"incr":   {run: cmdIncr},
+	"incrby": {args: 1, run: cmdIncr},
+	"scan":   {args: 1, run: cmdScan},
+}
+
+func parseExtended(msg string) (extendedCommand, extendedRequest, bool) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(msg, extendedPrefix), " ")
+	cmd, ok := extendedCommands[name]
+	if !ok {
+		return cmd, extendedRequest{}, false
+	}
+
+	fields := strings.SplitN(rest, " ", cmd.args+1)
+	if len(fields) != cmd.args+1 {
+		return cmd, extendedRequest{}, false
+	}
+
+	req := extendedRequest{command: name, args: fields[:cmd.args]}
+	req.key, req.val, req.hasVal = strings.Cut(fields[cmd.args], "=")
+	return cmd, req, true
+}
+
+func (s *Server) runExtended(ns, msg string) (string, error) {
+	cmd, req, ok := parseExtended(msg)
+	if !ok {
+		return "", nil
+	}
+	req.ns = ns
+
+	result, ok, err := cmd.run(s, req)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	reply := extendedPrefix + req.command + " "
+	for _, arg := range req.args {
+		reply += arg + " "
+	}
+	return reply + req.key + "=" + result, nil
+}
+
+// storeKey is the key the store holds req.key under.
+func (req extendedRequest) storeKey() string {
+	return namespaced(req.ns, req.key)
+}
+
+// !setex <seconds> key=value inserts a key that expires after the given
+// number of seconds.
+func cmdSetEx(s *Server, req extendedRequest) (string, bool, error) {
+	ttl, ok := parseTTL(req.args[0])
+	if !ok || !req.hasVal {
+		return "", false, nil
+	}
+	if isReadOnly(req.key) {
+		return "", false, nil
+	}
+	if err := s.Store.SetWithTTL(req.storeKey(), req.val, ttl); !isRejected(err) {
+		return "", false, err
+	}
+	return "", false, nil
+}
+
+// parseTTL parses a time to live given in seconds. It must be positive and
+// fit in a time.Duration.
+func parseTTL(s string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, false
+	}
+	if seconds <= 0 || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// !ttl key returns the whole number of seconds until key expires, rounded up,
+// -1 if it never does or -2 if it does not exist.
+func cmdTTL(s *Server, req extendedRequest) (string, bool, error) {
+	if isReadOnly(req.key) {
+		return "-1", true, nil
+	}
+
+	expires, ok := s.Store.Expiry(req.storeKey())
+	switch {
+	case !ok:
+		return "-2", true, nil
+	case expires.IsZero():
+		return "-1", true, nil
+	}
+
+	remaining := time.Until(expires)
+	return strconv.FormatInt(int64(math.Ceil(remaining.Seconds())), 10), true, nil
+}
+
+// update applies fn atomically to the key in req and returns the value it has
+// afterwards. Read-only keys and refused writes are left as they are.
+func (s *Server) update(req extendedRequest, keepTTL bool, fn func(val string, ok bool) (string, bool)) (string, bool, error) {
+	if isReadOnly(req.key) {
+		val, _ := s.get(req.ns, req.key)
+		return val, true, nil
+	}
+
+	val, err := s.Store.Update(req.storeKey(), keepTTL, fn)
+	if isRejected(err) {
+		val, _ = s.get(req.ns, req.key)
+		return val, true, nil
+	}
+	return val, err == nil, err
+}
+
+// !cas <expected> key=value sets key to value only if it exists and currently
+// holds expected, which is percent-encoded.
+func cmdCAS(s *Server, req extendedRequest) (string, bool, error) {
+	expected, err := url.PathUnescape(req.args[0])
+	if err != nil || !req.hasVal {
+		return "", false, nil
+	}
+	return s.update(req, false, func(val string, ok bool) (string, bool) {
+		return req.val, ok && val == expected
+	})
+}
+
+// !setnx key=value sets key to value only if it does not exist.
+func cmdSetNX(s *Server, req extendedRequest) (string, bool, error) {
+	if !req.hasVal {
+		return "", false, nil
+	}
+	return s.update(req, false, func(val string, ok bool) (string, bool) {
+		return req.val, !ok
+	})
+}
+
+// !append key=value adds value to the end of key, keeping any TTL.
+func cmdAppend(s *Server, req extendedRequest) (string, bool, error) {
+	if !req.hasVal {
+		return "", false, nil
+	}
+	return s.update(req, true, func(val string, ok bool) (string, bool) {
+		return val + req.val, true
+	})
+}
+
+// !incr key and !incrby <delta> key add to the integer in key, treating a
+// missing key as 0 and keeping any TTL. Keys that do not hold an integer, and
+// increments that would overflow, are left alone.
+func cmdIncr(s *Server, req extendedRequest) (string, bool, error) {
+	delta := int64(1)
+	if len(req.args) > 0 {
+		var err error
+		if delta, err = strconv.ParseInt(req.args[0], 10, 64); err != nil {
+			return "", false, nil
+		}
+	}
+	if req.hasVal {
+		return "", false, nil
+	}
+
+	return s.update(req, true, func(val string, ok bool) (string, bool) {
+		n := int64(0)
+		if ok {
+			var err error
+			if n, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return val, false
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return val, false
+		}
+		return strconv.FormatInt(n+delta, 10), true
+	})
+}
+
+// scanStart is the cursor that starts a scan, and that a reply carries once
+// there are no more keys.
+const scanStart = "0"
+
+// !scan <cursor> prefix lists the keys starting with prefix, as the next
+// cursor followed by the percent-encoded keys, all separated by spaces. Each
+// reply holds as many keys as fit in a datagram, and a scan goes on by sending
+// the cursor from the last reply until it is scanStart again. Keys too long to
+// fit in a reply are left out.
+func cmdScan(s *Server, req extendedRequest) (string, bool, error) {
+	if req.hasVal {
+		return "", false, nil
+	}
+	after, ok := decodeScanCursor(req.args[0])
+	if !ok {
+		return "", false, nil
+	}
+
+	keys := s.Store.Keys(namespaced(req.ns, req.key))
+	i := 0
+	if after != nil {
+		i = sort.SearchStrings(keys, namespaced(req.ns, *after)+"\x00")
+	}
+
+	// The reply is the request with "=" and the result appended.
+	room := maxDatagramSize - len(extendedPrefix+req.command+" "+req.args[0]+" "+req.key+"=")
+	var list strings.Builder
+	var last string
+	for ; i < len(keys); i++ {
+		key := strings.TrimPrefix(keys[i], namespaced(req.ns, ""))
+		escaped := escapeArg(key)
+		if list.Len()+1+len(escaped)+len(scanCursor(key)) > room {
+			if list.Len() > 0 {
+				break
+			}
+			last = key
+			continue
+		}
+		list.WriteString(" " + escaped)
+		last = key
+	}
+
+	if i == len(keys) {
+		return scanStart + list.String(), true, nil
+	}
+	return scanCursor(last) + list.String(), true, nil
+}
+
+func scanCursor(after string) string {
+	return "k" + base64.RawURLEncoding.EncodeToString([]byte(after))
+}
+
+// decodeScanCursor returns the key a scan goes on after, or nil for a scan
+// from the start.
+func decodeScanCursor(cursor string) (*string, bool) {
+	if cursor == scanStart {
+		return nil, true
+	}
+	if !strings.HasPrefix(cursor, "k") {
+		return nil, false
+	}
+	after, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cursor, "k"))
+	if err != nil {
+		return nil, false
+	}
+	key := string(after)
+	return &key, true
+}
+
+// escapeArg percent-encodes s so it can be read back with url.PathUnescape,
+// escaping only what cannot appear in a space separated argument.
+func escapeArg(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '%' || c >= 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,200 @@
+package unusualdatabase
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtendedRequestsAreOptIn(t *testing.T) {
+	conn := dial(t, startServer(t, NewServer()))
+
+	conn.Write([]byte("!setex 10 foo=bar"))
+	assert.Equal(t, "!setex 10 foo=bar", roundTrip(t, conn, "!setex 10 foo"))
+	assert.Equal(t, "foo=", roundTrip(t, conn, "foo"))
+}
+
+func TestTTL(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	conn := dial(t, startServer(t, s))
+
+	conn.Write([]byte("plain=value"))
+	conn.Write([]byte("!setex 100 foo=bar=baz"))
+	conn.Write([]byte("!setex 0.05 brief=value"))
+	conn.Write([]byte("!setex 100 version=nope"))
+
+	assert.Equal(t, "foo=bar=baz", roundTrip(t, conn, "foo"))
+	assert.Equal(t, "!ttl foo=100", roundTrip(t, conn, "!ttl foo"))
+	assert.Equal(t, "!ttl plain=-1", roundTrip(t, conn, "!ttl plain"))
+	assert.Equal(t, "!ttl missing=-2", roundTrip(t, conn, "!ttl missing"))
+	assert.Equal(t, "!ttl version=-1", roundTrip(t, conn, "!ttl version"))
+	assert.Equal(t, "version=jesse's cool kv database 1.0", roundTrip(t, conn, "version"))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "brief=", roundTrip(t, conn, "brief"))
+	assert.Equal(t, "!ttl brief=-2", roundTrip(t, conn, "!ttl brief"))
+
+	// A plain insert clears the TTL.
+	conn.Write([]byte("foo=forever"))
+	assert.Equal(t, "!ttl foo=-1", roundTrip(t, conn, "!ttl foo"))
+}
+
+func TestParseTTL(t *testing.T) {
+	for _, arg := range []string{"", "soon", "0", "-1", "NaN", "Inf", "-Inf", "1e300"} {
+		_, ok := parseTTL(arg)
+		assert.False(t, ok, arg)
+	}
+
+	ttl, ok := parseTTL("0.5")
+	assert.True(t, ok)
+	assert.Equal(t, 500*time.Millisecond, ttl)
+}
+
+func TestParseExtended(t *testing.T) {
+	tests := []struct {
+		Msg string
+		OK  bool
+		Req extendedRequest
+	}{
+		{Msg: "!ttl foo", OK: true, Req: extendedRequest{command: "ttl", args: []string{}, key: "foo"}},
+		{Msg: "!ttl foo bar", OK: true, Req: extendedRequest{command: "ttl", args: []string{}, key: "foo bar"}},
+		{Msg: "!setex 5 a b=c=d", OK: true, Req: extendedRequest{command: "setex", args: []string{"5"}, key: "a b", val: "c=d", hasVal: true}},
+		{Msg: "!setex 5", OK: false},
+		{Msg: "!nope foo", OK: false},
+	}
+
+	for _, test := range tests {
+		_, req, ok := parseExtended(test.Msg)
+		assert.Equal(t, test.OK, ok, test.Msg)
+		if ok {
+			assert.Equal(t, test.Req, req, test.Msg)
+		}
+	}
+}
+
+func TestAtomicOperations(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	conn := dial(t, startServer(t, s))
+
+	assert.Equal(t, "!setnx foo=a", roundTrip(t, conn, "!setnx foo=a"))
+	assert.Equal(t, "!setnx foo=a", roundTrip(t, conn, "!setnx foo=b"))
+
+	assert.Equal(t, "!cas b foo=a", roundTrip(t, conn, "!cas b foo=c"))
+	assert.Equal(t, "!cas a foo=c", roundTrip(t, conn, "!cas a foo=c"))
+	assert.Equal(t, "!cas a%20b bar=", roundTrip(t, conn, "!cas a%20b bar=c"))
+
+	conn.Write([]byte("spaced=a b"))
+	assert.Equal(t, "!cas a%20b spaced=c", roundTrip(t, conn, "!cas a%20b spaced=c"))
+
+	assert.Equal(t, "!append foo=cde", roundTrip(t, conn, "!append foo=de"))
+	assert.Equal(t, "!append new=x", roundTrip(t, conn, "!append new=x"))
+
+	assert.Equal(t, "!incr n=1", roundTrip(t, conn, "!incr n"))
+	assert.Equal(t, "!incrby -5 n=-4", roundTrip(t, conn, "!incrby -5 n"))
+	assert.Equal(t, "!incr foo=cde", roundTrip(t, conn, "!incr foo"))
+	conn.Write([]byte("big=9223372036854775807"))
+	assert.Equal(t, "!incr big=9223372036854775807", roundTrip(t, conn, "!incr big"))
+
+	// Special keys are never changed.
+	assert.Equal(t, "!append version=jesse's cool kv database 1.0", roundTrip(t, conn, "!append version=x"))
+
+	// append and incr keep the TTL, cas clears it.
+	conn.Write([]byte("!setex 100 brief=1"))
+	roundTrip(t, conn, "!incr brief")
+	assert.Equal(t, "!ttl brief=100", roundTrip(t, conn, "!ttl brief"))
+	roundTrip(t, conn, "!cas 2 brief=3")
+	assert.Equal(t, "!ttl brief=-1", roundTrip(t, conn, "!ttl brief"))
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	addr := startServer(t, s)
+
+	const clients, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				roundTrip(t, conn, "!incr counter")
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, _ := s.Store.Get("counter")
+	assert.Equal(t, strconv.Itoa(clients*increments), val)
+}
+
+func TestScan(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	conn := dial(t, startServer(t, s))
+
+	s.Store.Set("other", "x")
+	s.Store.Set("user/a b", "x")
+	var want []string
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("user/%03d", i)
+		s.Store.Set(key, strings.Repeat("x", i))
+		want = append(want, key)
+	}
+	want = append(want, "user/a%20b")
+
+	var got []string
+	cursor := scanStart
+	for pages := 0; ; pages++ {
+		request := "!scan " + cursor + " user/"
+		reply := roundTrip(t, conn, request)
+		assert.LessOrEqual(t, len(reply), maxDatagramSize)
+		if !assert.True(t, strings.HasPrefix(reply, request+"="), reply) {
+			return
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(reply, request+"="))
+		cursor = fields[0]
+		got = append(got, fields[1:]...)
+		if cursor == scanStart {
+			assert.Greater(t, pages, 0)
+			break
+		}
+	}
+	assert.Equal(t, want, got)
+
+	assert.Equal(t, "!scan 0 nothing=0", roundTrip(t, conn, "!scan 0 nothing"))
+}
+
+func TestParseScanCursor(t *testing.T) {
+	after, ok := decodeScanCursor(scanCursor("a b=c"))
+	assert.True(t, ok)
+	assert.Equal(t, "a b=c", *after)
+
+	after, ok = decodeScanCursor(scanStart)
+	assert.True(t, ok)
+	assert.Nil(t, after)
+
+	_, ok = decodeScanCursor("nope")
+	assert.False(t, ok)
+}
+
+func TestEscapeArg(t *testing.T) {
+	for _, s := range []string{"", "plain/key", "a b", "100%", "\x00\xff\n", "é"} {
+		escaped := escapeArg(s)
+		assert.NotContains(t, escaped, " ")
+		unescaped, err := url.PathUnescape(escaped)
+		assert.Nil(t, err)
+		assert.Equal(t, s, unescaped)
+	}
+	assert.Equal(t, "a%20b/c", escapeArg("a b/c"))
+}
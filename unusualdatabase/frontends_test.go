@@ -0,0 +1,139 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTCPServer(t *testing.T, s *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go s.serveTCP(listener)
+	return listener.Addr().String()
+}
+
+func httpDo(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestFrontendsShareStore(t *testing.T) {
+	s := NewServer()
+	udp := dial(t, startServer(t, s))
+	web := httptest.NewServer(s.HTTPHandler())
+	t.Cleanup(web.Close)
+
+	tcp, err := net.Dial("tcp", startTCPServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	tcp.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(tcp)
+	tcpRequest := func(msg string) string {
+		tcp.Write([]byte(msg + "\n"))
+		if !lines.Scan() {
+			t.Fatal(lines.Err())
+		}
+		return lines.Text()
+	}
+
+	// UDP to HTTP and TCP.
+	udp.Write([]byte("foo=bar"))
+	assert.Equal(t, "foo=bar", roundTrip(t, udp, "foo"))
+	status, body := httpDo(t, http.MethodGet, web.URL+"/kv/foo", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "bar", body)
+	assert.Equal(t, "foo=bar", tcpRequest("foo"))
+
+	// HTTP to UDP and TCP, with a key that needs escaping.
+	status, _ = httpDo(t, http.MethodPut, web.URL+"/kv/a%20b", "x=y")
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, "a b=x=y", tcpRequest("a b"))
+	assert.Equal(t, "a b=x=y", roundTrip(t, udp, "a b"))
+
+	// TCP to HTTP.
+	tcp.Write([]byte("baz=qux\n"))
+	assert.Equal(t, "baz=qux", tcpRequest("baz"))
+	_, body = httpDo(t, http.MethodGet, web.URL+"/kv/baz", "")
+	assert.Equal(t, "qux", body)
+
+	// Newlines and backslashes are escaped over TCP, so framing survives.
+	udp.Write([]byte("multi=line\none\\two"))
+	assert.Equal(t, "multi=line\none\\two", roundTrip(t, udp, "multi"))
+	assert.Equal(t, `multi=line\none\\two`, tcpRequest("multi"))
+	tcp.Write([]byte(`from\ntcp=a\rb` + "\n"))
+	assert.Equal(t, `from\ntcp=a\rb`, tcpRequest(`from\ntcp`))
+	assert.Equal(t, "from\ntcp=a\rb", roundTrip(t, udp, "from\ntcp"))
+
+	// Paths are not cleaned, so every key is reachable.
+	for _, key := range []string{"a//b", "x/../y", "/lead"} {
+		udp.Write([]byte(key + "=v"))
+		assert.Equal(t, key+"=v", roundTrip(t, udp, key))
+		status, body = httpDo(t, http.MethodGet, web.URL+"/kv/"+key, "")
+		assert.Equal(t, http.StatusOK, status, key)
+		assert.Equal(t, "v", body, key)
+	}
+	status, _ = httpDo(t, http.MethodGet, web.URL+"/elsewhere", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = httpDo(t, http.MethodDelete, web.URL+"/kv/foo", "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = httpDo(t, http.MethodDelete, web.URL+"/kv/foo", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = httpDo(t, http.MethodGet, web.URL+"/kv/foo", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "foo=", roundTrip(t, udp, "foo"))
+}
+
+func TestHTTPSpecialCases(t *testing.T) {
+	s := NewServer()
+	s.Store.Limits = Limits{MaxKeys: 1, Policy: EvictReject}
+	web := httptest.NewServer(s.HTTPHandler())
+	t.Cleanup(web.Close)
+
+	status, body := httpDo(t, http.MethodGet, web.URL+"/kv/version", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, s.Version, body)
+	status, _ = httpDo(t, http.MethodPut, web.URL+"/kv/version", "nope")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = httpDo(t, http.MethodDelete, web.URL+"/kv/version", "")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = httpDo(t, http.MethodPut, web.URL+"/kv/brief?ttl=10", "x")
+	assert.Equal(t, http.StatusNoContent, status)
+	_, ok := s.Store.Expiry("brief")
+	assert.True(t, ok)
+	for _, ttl := range []string{"soon", "NaN", "Inf", "1e300"} {
+		status, _ = httpDo(t, http.MethodPut, web.URL+"/kv/brief?ttl="+ttl, "x")
+		assert.Equal(t, http.StatusBadRequest, status, ttl)
+	}
+
+	status, _ = httpDo(t, http.MethodPut, web.URL+"/kv/another", "x")
+	assert.Equal(t, http.StatusInsufficientStorage, status)
+
+	status, _ = httpDo(t, http.MethodPost, web.URL+"/kv/brief", "x")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+}
@@ -0,0 +1,136 @@
+package unusualdatabase
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	httpKeyPrefix   = "/kv/"
+	maxHTTPBodySize = 1 << 20
+)
+
+// HTTPHandler serves the store as a REST API:
+//
+//	GET    /kv/<key>                  the value, or 404
+//	PUT    /kv/<key>[?ttl=<seconds>]  set the value to the request body
+//	DELETE /kv/<key>                  remove the key, or 404
+//
+// Keys are URL decoded, so they can contain anything the datagram syntax can.
+// Paths are taken as sent rather than cleaned, so keys like "a//b" or
+// "x/../y" work too.
+func (s *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(s.serveKey)
+}
+
+func (s *Server) ListenHTTP(addr string) {
+	log.Fatal(http.ListenAndServe(addr, s.HTTPHandler()))
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, httpKeyPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := url.PathUnescape(strings.TrimPrefix(path, httpKeyPrefix))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ns := s.namespaceOfRequest(r)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		val, ok := s.get(ns, key)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+		io.WriteString(w, val)
+
+	case http.MethodPut:
+		if isReadOnly(key) {
+			http.Error(w, "key is read-only", http.StatusForbidden)
+			return
+		}
+
+		var ttl time.Duration
+		if param := r.URL.Query().Get("ttl"); param != "" {
+			var ok bool
+			if ttl, ok = parseTTL(param); !ok {
+				http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+				return
+			}
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if ttl > 0 {
+			err = s.Store.SetWithTTL(namespaced(ns, key), string(body), ttl)
+		} else {
+			err = s.Store.Set(namespaced(ns, key), string(body))
+		}
+		if errors.Is(err, ErrStoreFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if isReadOnly(key) {
+			http.Error(w, "key is read-only", http.StatusForbidden)
+			return
+		}
+
+		ok, err := s.Store.Delete(namespaced(ns, key))
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) namespaceOfRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return s.namespaceOfIP(net.ParseIP(host))
+}
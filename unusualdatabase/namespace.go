@@ -0,0 +1,78 @@
+package unusualdatabase
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// namespaceSeparator joins a namespace to the keys in it. A namespace is just
+// a key prefix, so clients outside every namespace can reach the keys in one
+// as "<namespace>/<key>", and list them with a prefix scan.
+const namespaceSeparator = "/"
+
+type namespace struct {
+	name    string
+	network *net.IPNet
+}
+
+// AddNamespace confines the given clients, each an IP address or CIDR network,
+// to their own namespace. They see only the keys in it, without the prefix,
+// and cannot reach keys outside it. A client in several namespaces gets the
+// one that was added first. AddNamespace must be called before serving.
+func (s *Server) AddNamespace(name string, clients ...string) error {
+	if name == "" || strings.ContainsAny(name, namespaceSeparator+"= ") {
+		return fmt.Errorf("invalid namespace name %q", name)
+	}
+
+	for _, client := range clients {
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return fmt.Errorf("namespace %s: invalid client %q", name, client)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		}
+		s.namespaces = append(s.namespaces, namespace{name: name, network: network})
+	}
+	return nil
+}
+
+// namespaceOf returns the namespace addr is confined to, or "" if none.
+func (s *Server) namespaceOf(addr net.Addr) string {
+	if len(s.namespaces) == 0 {
+		return ""
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return ""
+	}
+	return s.namespaceOfIP(ip)
+}
+
+func (s *Server) namespaceOfIP(ip net.IP) string {
+	for _, ns := range s.namespaces {
+		if ns.network.Contains(ip) {
+			return ns.name
+		}
+	}
+	return ""
+}
+
+// namespaced returns the key the store holds key under for namespace ns.
+func namespaced(ns, key string) string {
+	if ns == "" {
+		return key
+	}
+	return ns + namespaceSeparator + key
+}
@@ -0,0 +1,40 @@
+package unusualdatabase
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	assert.Nil(t, s.AddNamespace("team", "127.0.0.0/8"))
+	assert.Nil(t, s.AddNamespace("other", "127.0.0.1", "::1"))
+	conn := dial(t, startServer(t, s))
+
+	s.Store.Set("foo", "global")
+	conn.Write([]byte("foo=bar"))
+	conn.Write([]byte("version=nope"))
+
+	assert.Equal(t, "foo=bar", roundTrip(t, conn, "foo"))
+	assert.Equal(t, "!incr n=1", roundTrip(t, conn, "!incr n"))
+	assert.Equal(t, "!scan 0 =0 foo n", roundTrip(t, conn, "!scan 0 "))
+	assert.Equal(t, "version=jesse's cool kv database 1.0", roundTrip(t, conn, "version"))
+
+	val, _ := s.Store.Get("team/foo")
+	assert.Equal(t, "bar", val)
+	val, _ = s.Store.Get("foo")
+	assert.Equal(t, "global", val)
+
+	assert.Equal(t, "other", s.namespaceOfIP(net.ParseIP("::1")))
+	assert.Equal(t, "", s.namespaceOfIP(net.ParseIP("10.0.0.1")))
+}
+
+func TestAddNamespaceRejectsInvalid(t *testing.T) {
+	s := NewServer()
+	assert.Error(t, s.AddNamespace("a/b", "127.0.0.1"))
+	assert.Error(t, s.AddNamespace("", "127.0.0.1"))
+	assert.Error(t, s.AddNamespace("team", "not an address"))
+}
@@ -0,0 +1,475 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication streams records in the same framing as the write-ahead log.
+//
+// Both sides first prove they know Server.ReplicationSecret. The primary sends
+// opChallenge with a random nonce as the key. The follower answers with
+// opProof, holding a nonce of its own as the key and an HMAC of the primary's
+// nonce as the value, and the primary answers that with an opProof of its own.
+//
+// A follower then receives opSnapshotStart, the whole store, and
+// opSnapshotEnd, followed by every change as it happens. opHeartbeat is sent
+// when there have been no changes for a while, so followers can tell a quiet
+// primary from a dead one.
+const (
+	opSnapshotStart byte = 4
+	opSnapshotEnd   byte = 5
+	opHeartbeat     byte = 6
+	opChallenge     byte = 7
+	opProof         byte = 8
+)
+
+const (
+	replicaQueueSize     = 1024
+	replicationHeartbeat = time.Second
+	replicationTimeout   = 3 * replicationHeartbeat
+)
+
+var ErrReadOnly = errors.New("store is a read-only follower")
+
+var (
+	errNotPrimary = errors.New("not a primary")
+	errBadProof   = errors.New("wrong replication secret")
+)
+
+type replica struct {
+	records chan []byte
+}
+
+// SetReadOnly makes writes other than those replicated from a primary fail
+// with ErrReadOnly.
+func (st *Store) SetReadOnly(readOnly bool) {
+	st.readOnly.Store(readOnly)
+}
+
+func (st *Store) ReadOnly() bool {
+	return st.readOnly.Load()
+}
+
+func (st *Store) replicating() bool {
+	return st.replicaCount.Load() > 0
+}
+
+func (st *Store) subscribe() *replica {
+	r := &replica{records: make(chan []byte, replicaQueueSize)}
+
+	st.replicasMu.Lock()
+	st.replicas[r] = true
+	st.replicaCount.Store(int32(len(st.replicas)))
+	st.replicasMu.Unlock()
+	return r
+}
+
+func (st *Store) unsubscribe(r *replica) {
+	st.replicasMu.Lock()
+	defer st.replicasMu.Unlock()
+	st.dropReplicaLocked(r)
+}
+
+func (st *Store) dropReplicaLocked(r *replica) {
+	if st.replicas[r] {
+		delete(st.replicas, r)
+		close(r.records)
+		st.replicaCount.Store(int32(len(st.replicas)))
+	}
+}
+
+// publish queues a record for every follower. A follower that cannot keep up
+// is dropped, and will resync from a fresh snapshot when it reconnects.
+func (st *Store) publish(record []byte) {
+	st.replicasMu.Lock()
+	defer st.replicasMu.Unlock()
+
+	for r := range st.replicas {
+		select {
+		case r.records <- record:
+		default:
+			log.Println("replication: follower is too slow, dropping it")
+			st.dropReplicaLocked(r)
+		}
+	}
+}
+
+// dropReplicas disconnects every follower.
+func (st *Store) dropReplicas() {
+	st.replicasMu.Lock()
+	defer st.replicasMu.Unlock()
+
+	for r := range st.replicas {
+		st.dropReplicaLocked(r)
+	}
+}
+
+// applyReplicated applies a record from the primary, logging it and passing
+// it on as if it had been written here.
+func (st *Store) applyReplicated(key string, e *entry) error {
+	sh := st.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if err := st.logWrite(key, e); err != nil {
+		return err
+	}
+	st.replaceLocked(sh, key, e)
+	if e != nil && !e.expires.IsZero() {
+		st.startExpiry()
+	}
+	return nil
+}
+
+// replaceAll makes the store hold exactly the given entries.
+func (st *Store) replaceAll(entries map[string]*entry) error {
+	for i := range st.shards {
+		st.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range st.shards {
+			st.shards[i].mu.Unlock()
+		}
+	}()
+
+	for i := range st.shards {
+		sh := &st.shards[i]
+		for key := range sh.kv {
+			if _, ok := entries[key]; ok {
+				continue
+			}
+			if err := st.logWrite(key, nil); err != nil {
+				return err
+			}
+			st.replaceLocked(sh, key, nil)
+		}
+	}
+
+	for key, e := range entries {
+		if err := st.logWrite(key, e); err != nil {
+			return err
+		}
+		st.replaceLocked(st.shard(key), key, e)
+		if !e.expires.IsZero() {
+			st.startExpiry()
+		}
+	}
+	return nil
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// replicationProof shows that the given side of a link knows the secret, in
+// answer to a nonce. Including the side stops a proof being reflected back.
+func (s *Server) replicationProof(nonce, side string) string {
+	mac := hmac.New(sha256.New, []byte(s.ReplicationSecret))
+	mac.Write([]byte(nonce + "\n" + side))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticateFollower runs the primary's side of the handshake.
+func (s *Server) authenticateFollower(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(replicationTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(encodeRecord(opChallenge, nonce, "")); err != nil {
+		return err
+	}
+
+	op, theirNonce, proof, _, err := readRecord(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if op != opProof || theirNonce == "" || !hmac.Equal([]byte(proof), []byte(s.replicationProof(nonce, "follower"))) {
+		return errBadProof
+	}
+	_, err = conn.Write(encodeRecord(opProof, "", s.replicationProof(theirNonce, "primary")))
+	return err
+}
+
+// ListenReplication accepts followers on addr for as long as s is a primary.
+func (s *Server) ListenReplication(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.serveReplication(listener)
+}
+
+func (s *Server) serveReplication(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("replication accept error", err)
+			return
+		}
+
+		go s.serveFollower(conn)
+	}
+}
+
+func (s *Server) serveFollower(conn net.Conn) {
+	defer conn.Close()
+
+	// Followers only ever talk to the primary, so that they cannot form a
+	// loop. They retry their next upstream when turned away.
+	if s.Store.ReadOnly() {
+		return
+	}
+
+	if s.ReplicationSecret == "" {
+		log.Println("replication: refusing follower, no secret set")
+		return
+	}
+	if err := s.authenticateFollower(conn); err != nil {
+		log.Printf("replication: follower %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Subscribe before taking the snapshot so that nothing written in between
+	// is lost. Changes that make it into both are applied twice, which ends
+	// with the same result.
+	r := s.Store.subscribe()
+	defer s.Store.unsubscribe(r)
+
+	write := func(data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		_, err := conn.Write(data)
+		return err
+	}
+
+	if err := write(encodeRecord(opSnapshotStart, "", "")); err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	for i := range s.Store.shards {
+		sh := &s.Store.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.kv {
+			buf.Write(encodeEntry(key, e))
+		}
+		sh.mu.RUnlock()
+
+		if err := write(buf.Bytes()); err != nil {
+			return
+		}
+		buf.Reset()
+	}
+	if err := write(encodeRecord(opSnapshotEnd, "", "")); err != nil {
+		return
+	}
+	log.Printf("replication: follower %s is in sync", conn.RemoteAddr())
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case record, ok := <-r.records:
+			if !ok {
+				return
+			}
+			if err := write(record); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := write(encodeRecord(opHeartbeat, "", "")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Follower keeps a read-only copy of a primary's store. Upstreams are tried
+// in order until one accepts, so listing a standby after the primary lets a
+// follower move over once the standby has been promoted.
+//
+// A follower with PromoteAfter set promotes itself to primary once it has
+// been unable to reach any upstream for that long. Only one follower should
+// be set up to do so, and the old primary must come back as a follower.
+type Follower struct {
+	Upstreams     []string
+	PromoteAfter  time.Duration
+	RetryInterval time.Duration
+
+	s        *Server
+	promote  chan struct{}
+	once     sync.Once
+	conn     net.Conn
+	connMu   sync.Mutex
+	promoted atomic.Bool
+}
+
+// Follow makes s a read-only follower of the first reachable upstream. The
+// caller must call Run to start replicating.
+func (s *Server) Follow(upstreams ...string) *Follower {
+	s.Store.SetReadOnly(true)
+	return &Follower{
+		Upstreams:     upstreams,
+		RetryInterval: time.Second,
+		s:             s,
+		promote:       make(chan struct{}),
+	}
+}
+
+// Run replicates from the upstreams until the follower is promoted.
+func (f *Follower) Run() {
+	lastContact := time.Now()
+
+	for {
+		for _, addr := range f.Upstreams {
+			if f.promoted.Load() {
+				return
+			}
+
+			err := f.sync(addr)
+			if !errors.Is(err, errNotPrimary) {
+				lastContact = time.Now()
+			}
+			if err != nil && !errors.Is(err, errNotPrimary) && !f.promoted.Load() {
+				log.Printf("replication: %s: %v", addr, err)
+			}
+		}
+
+		if f.PromoteAfter > 0 && time.Since(lastContact) >= f.PromoteAfter {
+			log.Printf("replication: no primary for %s, promoting", f.PromoteAfter)
+			f.Promote()
+		}
+
+		select {
+		case <-f.promote:
+			return
+		case <-time.After(f.RetryInterval):
+		}
+	}
+}
+
+// Promote stops following and makes the store writable.
+func (f *Follower) Promote() {
+	f.once.Do(func() {
+		f.promoted.Store(true)
+		f.s.Store.SetReadOnly(false)
+		close(f.promote)
+
+		f.connMu.Lock()
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		f.connMu.Unlock()
+	})
+}
+
+// sync follows the primary at addr until the connection drops. It returns
+// errNotPrimary if addr could not be reached or turned the follower away
+// before sending anything.
+func (f *Follower) sync(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, replicationTimeout)
+	if err != nil {
+		return errNotPrimary
+	}
+	defer conn.Close()
+
+	f.connMu.Lock()
+	if f.promoted.Load() {
+		f.connMu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.connMu.Unlock()
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+
+	var (
+		authenticated bool
+		started       bool
+		snapshot      map[string]*entry
+		applyErr      error
+	)
+
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	_, err = readRecords(conn, func(op byte, key, val string) {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		if applyErr != nil {
+			return
+		}
+
+		switch {
+		case op == opChallenge:
+			proof := f.s.replicationProof(key, "follower")
+			conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+			_, applyErr = conn.Write(encodeRecord(opProof, nonce, proof))
+		case op == opProof:
+			if !hmac.Equal([]byte(val), []byte(f.s.replicationProof(nonce, "primary"))) {
+				applyErr = errBadProof
+			}
+			authenticated = applyErr == nil
+		case !authenticated:
+			// Nothing is applied from a primary that has not proved itself.
+			applyErr = errBadProof
+		}
+		if applyErr != nil {
+			conn.Close()
+			return
+		}
+
+		switch op {
+		case opChallenge, opProof:
+		case opSnapshotStart:
+			started = true
+			snapshot = make(map[string]*entry)
+		case opSnapshotEnd:
+			applyErr = f.s.Store.replaceAll(snapshot)
+			snapshot = nil
+			log.Printf("replication: in sync with %s", addr)
+		case opHeartbeat:
+		default:
+			e, ok := decodeEntry(op, val)
+			switch {
+			case !ok:
+			case snapshot != nil && e != nil:
+				snapshot[key] = e
+			case snapshot == nil:
+				applyErr = f.s.Store.applyReplicated(key, e)
+			}
+		}
+
+		if applyErr != nil {
+			conn.Close()
+		}
+	})
+
+	switch {
+	case applyErr != nil:
+		return applyErr
+	case !started:
+		return errNotPrimary
+	case err == nil:
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package unusualdatabase
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testReplicationSecret = "hunter2"
+
+func startReplication(t *testing.T, s *Server) (string, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	if s.ReplicationSecret == "" {
+		s.ReplicationSecret = testReplicationSecret
+	}
+	go s.serveReplication(listener)
+	return listener.Addr().String(), listener
+}
+
+func startFollower(t *testing.T, s *Server, promoteAfter time.Duration, upstreams ...string) *Follower {
+	if s.ReplicationSecret == "" {
+		s.ReplicationSecret = testReplicationSecret
+	}
+	f := s.Follow(upstreams...)
+	f.RetryInterval = 10 * time.Millisecond
+	f.PromoteAfter = promoteAfter
+	t.Cleanup(f.Promote)
+
+	go f.Run()
+	return f
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func hasValue(st *Store, key, want string) func() bool {
+	return func() bool {
+		val, ok := st.Get(key)
+		return ok && val == want
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary := NewServer()
+	primary.Store.Set("before", "snapshot")
+	primary.Store.Set("doomed", "x")
+	addr, _ := startReplication(t, primary)
+
+	follower := NewServer()
+	follower.Store.Set("stale", "x")
+	startFollower(t, follower, 0, addr)
+
+	waitFor(t, "snapshot", hasValue(follower.Store, "before", "snapshot"))
+	_, ok := follower.Store.Get("stale")
+	assert.False(t, ok, "the snapshot replaces what the follower had")
+
+	primary.Store.Set("after", "stream")
+	primary.Store.SetWithTTL("expiring", "x", time.Hour)
+	primary.Store.Delete("doomed")
+	waitFor(t, "updates", hasValue(follower.Store, "after", "stream"))
+	waitFor(t, "delete", func() bool {
+		_, ok := follower.Store.Get("doomed")
+		return !ok
+	})
+	expires, _ := primary.Store.Expiry("expiring")
+	followerExpires, _ := follower.Store.Expiry("expiring")
+	assert.True(t, expires.Equal(followerExpires))
+
+	// Followers serve reads but refuse writes from clients.
+	assert.Equal(t, ErrReadOnly, follower.Store.Set("after", "mine"))
+	conn := dial(t, startServer(t, follower))
+	conn.Write([]byte("after=mine"))
+	assert.Equal(t, "after=stream", roundTrip(t, conn, "after"))
+}
+
+func TestReplicationOfEvictions(t *testing.T) {
+	primary := NewServer()
+	primary.Store.Limits = Limits{MaxKeys: 10, Policy: EvictLRU}
+	addr, _ := startReplication(t, primary)
+
+	follower := NewServer()
+	startFollower(t, follower, 0, addr)
+	waitFor(t, "follower", func() bool { return primary.Store.replicating() })
+
+	fill(primary.Store, 0, 50)
+	waitFor(t, "last key", hasValue(follower.Store, "key49", "value"))
+	assert.Equal(t, 10, follower.Store.Len())
+}
+
+func TestPromotion(t *testing.T) {
+	primary := NewServer()
+	primary.Store.Set("key", "from primary")
+	primaryAddr, primaryListener := startReplication(t, primary)
+
+	standby := NewServer()
+	standbyAddr, _ := startReplication(t, standby)
+	startFollower(t, standby, 100*time.Millisecond, primaryAddr)
+
+	// This follower is turned away by the standby until it is promoted.
+	follower := NewServer()
+	startFollower(t, follower, 0, primaryAddr, standbyAddr)
+
+	waitFor(t, "standby", hasValue(standby.Store, "key", "from primary"))
+	waitFor(t, "follower", hasValue(follower.Store, "key", "from primary"))
+
+	primaryListener.Close()
+	primary.Store.dropReplicas()
+
+	waitFor(t, "promotion", func() bool { return !standby.Store.ReadOnly() })
+	assert.Nil(t, standby.Store.Set("key", "from standby"))
+	waitFor(t, "follower to move over", hasValue(follower.Store, "key", "from standby"))
+	assert.True(t, follower.Store.ReadOnly())
+}
+
+func TestReplicationNeedsSecret(t *testing.T) {
+	primary := NewServer()
+	primary.Store.Set("secret", "data")
+	addr, _ := startReplication(t, primary)
+
+	// A stranger gets a challenge and nothing else.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(encodeRecord(opProof, "nonce", "guess"))
+	var ops []byte
+	_, err = readRecords(conn, func(op byte, key, val string) { ops = append(ops, op) })
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{opChallenge}, ops)
+
+	follower := NewServer()
+	follower.ReplicationSecret = "wrong"
+	startFollower(t, follower, 0, addr)
+	time.Sleep(100 * time.Millisecond)
+	_, ok := follower.Store.Get("secret")
+	assert.False(t, ok)
+}
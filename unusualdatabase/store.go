@@ -0,0 +1,310 @@
+package unusualdatabase
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const storeShards = 64
+
+// expiryInterval is how often keys with a TTL are swept, so that expired keys
+// nobody reads again do not linger in memory.
+const expiryInterval = time.Second
+
+type entry struct {
+	val string
+	// expires is when the entry stops existing, or zero if it never does.
+	expires time.Time
+
+	// Usage for eviction, updated under a read lock.
+	lastAccess atomic.Int64
+	hits       atomic.Uint32
+}
+
+func newEntry(val string, expires time.Time) *entry {
+	e := &entry{val: val, expires: expires}
+	e.lastAccess.Store(time.Now().UnixNano())
+	return e
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// size is what an entry counts for against Limits.MaxBytes.
+func entrySize(key string, e *entry) int64 {
+	return int64(len(key) + len(e.val))
+}
+
+type shard struct {
+	kv map[string]*entry
+	mu sync.RWMutex
+}
+
+// Store is a key-value map split into shards so that requests for different
+// keys rarely wait on the same lock. Stores from NewStore live in memory only;
+// OpenStore returns one that survives restarts.
+type Store struct {
+	// Limits bounds the size of the store. It must be set before the store
+	// is used.
+	Limits Limits
+
+	shards  [storeShards]shard
+	durable *durableState
+	keys    atomic.Int64
+	bytes   atomic.Int64
+	evictMu sync.Mutex
+
+	readOnly     atomic.Bool
+	replicas     map[*replica]bool
+	replicaCount atomic.Int32
+	replicasMu   sync.Mutex
+
+	expiryOnce sync.Once
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+func NewStore() *Store {
+	st := &Store{
+		replicas: make(map[*replica]bool),
+		stop:     make(chan struct{}),
+	}
+	for i := range st.shards {
+		st.shards[i].kv = make(map[string]*entry)
+	}
+	return st
+}
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (st *Store) shard(key string) *shard {
+	return &st.shards[keyHash(key)%storeShards]
+}
+
+func (st *Store) Get(key string) (string, bool) {
+	sh := st.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.kv[key]
+	if !ok || e.expired(time.Now()) {
+		return "", false
+	}
+	st.touch(e)
+	return e.val, true
+}
+
+// Expiry returns when key expires, or the zero time if it does not.
+func (st *Store) Expiry(key string) (time.Time, bool) {
+	sh := st.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	e, ok := sh.kv[key]
+	if !ok || e.expired(time.Now()) {
+		return time.Time{}, false
+	}
+	return e.expires, true
+}
+
+// Set stores val under key with no expiry, replacing any earlier TTL.
+func (st *Store) Set(key, val string) error {
+	return st.set(key, newEntry(val, time.Time{}))
+}
+
+// Update atomically replaces the value of key with the result of fn, which is
+// given the current value and whether the key exists, and reports whether to
+// store the value it returns. With keepTTL, the key keeps any expiry it had.
+// Update returns the value key has afterwards.
+func (st *Store) Update(key string, keepTTL bool, fn func(val string, ok bool) (string, bool)) (string, error) {
+	var result string
+	err := st.update(key, func(old *entry) *entry {
+		if old == nil {
+			val, write := fn("", false)
+			if !write {
+				return nil
+			}
+			result = val
+			return newEntry(val, time.Time{})
+		}
+
+		result = old.val
+		val, write := fn(old.val, true)
+		if !write {
+			return nil
+		}
+		result = val
+
+		var expires time.Time
+		if keepTTL {
+			expires = old.expires
+		}
+		return newEntry(val, expires)
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// SetWithTTL stores val under key until ttl has passed.
+func (st *Store) SetWithTTL(key, val string, ttl time.Duration) error {
+	st.startExpiry()
+	return st.set(key, newEntry(val, time.Now().Add(ttl)))
+}
+
+func (st *Store) set(key string, e *entry) error {
+	return st.update(key, func(*entry) *entry { return e })
+}
+
+// update replaces the entry for key with the one fn returns, unless it returns
+// nil. fn is called with the shard locked and given the current entry, or nil
+// if there is none.
+func (st *Store) update(key string, fn func(old *entry) *entry) error {
+	if st.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	sh := st.shard(key)
+	sh.mu.Lock()
+
+	old := sh.kv[key]
+	current := old
+	if current != nil && current.expired(time.Now()) {
+		current = nil
+	}
+	e := fn(current)
+	if e == nil {
+		sh.mu.Unlock()
+		return nil
+	}
+
+	if !st.admit(key, old, e) {
+		sh.mu.Unlock()
+		rejectedInserts.Add(1)
+		return ErrStoreFull
+	}
+	if old != nil {
+		e.hits.Store(old.hits.Load())
+	}
+	st.touch(e)
+
+	if err := st.logWrite(key, e); err != nil {
+		sh.mu.Unlock()
+		return err
+	}
+	st.replaceLocked(sh, key, e)
+	sh.mu.Unlock()
+
+	st.evict(key)
+	return nil
+}
+
+// Delete removes key and reports whether it existed.
+func (st *Store) Delete(key string) (bool, error) {
+	if st.ReadOnly() {
+		return false, ErrReadOnly
+	}
+
+	sh := st.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.kv[key]
+	if !ok {
+		return false, nil
+	}
+	if err := st.logWrite(key, nil); err != nil {
+		return false, err
+	}
+	st.replaceLocked(sh, key, nil)
+	return !e.expired(time.Now()), nil
+}
+
+// replaceLocked puts e under key, or deletes key if e is nil, keeping the
+// size counters up to date. The caller must hold the lock on sh.
+func (st *Store) replaceLocked(sh *shard, key string, e *entry) {
+	if old, ok := sh.kv[key]; ok {
+		st.keys.Add(-1)
+		st.bytes.Add(-entrySize(key, old))
+	}
+	if e == nil {
+		delete(sh.kv, key)
+		return
+	}
+	sh.kv[key] = e
+	st.keys.Add(1)
+	st.bytes.Add(entrySize(key, e))
+}
+
+// Keys returns the keys starting with prefix in sorted order.
+func (st *Store) Keys(prefix string) []string {
+	now := time.Now()
+	var keys []string
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.RLock()
+		for key, e := range sh.kv {
+			if strings.HasPrefix(key, prefix) && !e.expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len counts the keys in the store, including expired keys that have not been
+// swept yet.
+func (st *Store) Len() int {
+	return int(st.keys.Load())
+}
+
+// Bytes is the total size of the keys and values in the store.
+func (st *Store) Bytes() int64 {
+	return st.bytes.Load()
+}
+
+func (st *Store) startExpiry() {
+	st.expiryOnce.Do(func() {
+		go st.expireEvery(expiryInterval)
+	})
+}
+
+func (st *Store) expireEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-st.stop:
+			return
+		case now := <-ticker.C:
+			st.expire(now)
+		}
+	}
+}
+
+// expire deletes every key that has expired by now. Deletions are not logged:
+// the logged entry carries its expiry time, so it is dropped again when it is
+// replayed.
+func (st *Store) expire(now time.Time) {
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.Lock()
+		for key, e := range sh.kv {
+			if e.expired(now) {
+				st.replaceLocked(sh, key, nil)
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
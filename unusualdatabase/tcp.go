@@ -0,0 +1,59 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	escapeLine   = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	unescapeLine = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+)
+
+// ListenTCP serves the store over TCP. Each line is a request in the same
+// syntax as a datagram, and each reply is sent back as a line. Keys and values
+// can hold newlines when written over UDP or HTTP, so lines are escaped in
+// both directions: a backslash, newline or carriage return is sent as \\, \n
+// or \r.
+func (s *Server) ListenTCP(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.serveTCP(listener)
+}
+
+func (s *Server) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("tcp accept error", err)
+			return
+		}
+
+		go s.handleTCPConnection(conn)
+	}
+}
+
+func (s *Server) handleTCPConnection(conn net.Conn) {
+	defer conn.Close()
+
+	ns := s.namespaceOf(conn.RemoteAddr())
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		reply, err := s.respond(ns, unescapeLine.Replace(scanner.Text()))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if reply == "" {
+			continue
+		}
+
+		if _, err := conn.Write([]byte(escapeLine.Replace(reply) + "\n")); err != nil {
+			return
+		}
+	}
+}
@@ -1,58 +1,184 @@
 package unusualdatabase
 
 import (
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
+	"runtime"
 	"strings"
+	"time"
+)
+
+const workerQueueSize = 64
+
+// maxDatagramSize is the largest request or reply the protocol allows, which
+// must be shorter than 1000 bytes.
+const maxDatagramSize = 999
+
+var (
+	oversizedRequests = expvar.NewInt("unusualdatabase_oversized_requests")
+	oversizedReplies  = expvar.NewInt("unusualdatabase_oversized_replies")
 )
 
 type Server struct {
-	KV map[string]string
+	Store *Store
+	// Version is the value of the "version" key.
+	Version string
+	// Workers is the number of goroutines handling requests, or 0 for one per
+	// CPU.
+	Workers int
+	// Extended enables requests starting with "!", such as inserts with a TTL.
+	// Keys starting with "!" cannot be used while it is set.
+	Extended bool
+	// ReplicationSecret is shared by a primary and its followers. Links from
+	// either side that cannot prove they know it are refused, as are all links
+	// if it is empty.
+	ReplicationSecret string
+
+	namespaces []namespace
+	started    time.Time
+}
+
+func NewServer() *Server {
+	return &Server{
+		Store:   NewStore(),
+		Version: defaultVersion(),
+		started: time.Now(),
+	}
+}
+
+type request struct {
+	sender net.Addr
+	msg    string
 }
 
-func NewServer() Server {
-	return Server{
-		KV: make(map[string]string),
+func (s *Server) isExtended(msg string) bool {
+	return s.Extended && strings.HasPrefix(msg, extendedPrefix)
+}
+
+// requestKey returns the key a request reads or writes.
+func (s *Server) requestKey(msg string) string {
+	if s.isExtended(msg) {
+		_, req, _ := parseExtended(msg)
+		return req.key
 	}
+	key, _, _ := strings.Cut(msg, "=")
+	return key
 }
 
-func (s Server) handleMessage(conn net.PacketConn, sender net.Addr, msg string) error {
+// respond handles one request, from any front-end that speaks the datagram
+// syntax, for a client in namespace ns and returns the reply or "" if there is
+// none.
+func (s *Server) respond(ns, msg string) (string, error) {
+	if s.isExtended(msg) {
+		return s.runExtended(ns, msg)
+	}
+
 	if strings.ContainsRune(msg, '=') {
 		split := strings.SplitN(msg, "=", 2)
-		s.KV[split[0]] = split[1]
-		return nil
+		if isReadOnly(split[0]) {
+			return "", nil
+		}
+		if err := s.Store.Set(namespaced(ns, split[0]), split[1]); !isRejected(err) {
+			return "", err
+		}
+		return "", nil
 	}
 
-	val := s.KV[msg]
-	if msg == "version" {
-		val = "jesse's cool kv database 1.0"
+	val, _ := s.get(ns, msg)
+	return fmt.Sprintf("%s=%s", msg, val), nil
+}
+
+// isRejected reports whether err means a write was refused rather than failed.
+func isRejected(err error) bool {
+	return err == ErrStoreFull || err == ErrReadOnly
+}
+
+// get reads key in namespace ns, answering for the special keys that are not
+// in the store.
+func (s *Server) get(ns, key string) (string, bool) {
+	if admin, ok := adminKeys[key]; ok {
+		return admin(s), true
 	}
+	return s.Store.Get(namespaced(ns, key))
+}
 
-	_, err := conn.WriteTo([]byte(fmt.Sprintf("%s=%s", msg, val)), sender)
+// handleMessage answers one datagram. Keys and values are bytes rather than
+// text, so they need not be valid UTF-8. Replies too long for a datagram are
+// dropped rather than cut short, since a truncated value would look like a
+// real one.
+func (s *Server) handleMessage(conn net.PacketConn, sender net.Addr, msg string) error {
+	reply, err := s.respond(s.namespaceOf(sender), msg)
+	if err != nil || reply == "" {
+		return err
+	}
+	if len(reply) > maxDatagramSize {
+		oversizedReplies.Add(1)
+		return nil
+	}
+	_, err = conn.WriteTo([]byte(reply), sender)
 	return err
 }
 
-func (s Server) Listen(addr string) {
+func (s *Server) Listen(addr string) {
 	conn, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	buf := make([]byte, 1000)
+	s.serve(conn)
+}
+
+// serve reads datagrams from conn and hands them to a pool of workers. Every
+// request for a key goes to the same worker, so requests for one key are
+// still handled in the order they arrived.
+func (s *Server) serve(conn net.PacketConn) {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	queues := make([]chan request, workers)
+	for i := range queues {
+		queues[i] = make(chan request, workerQueueSize)
+		go s.work(conn, queues[i])
+	}
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}()
+
+	// One byte more than the limit, so that datagrams over it can be told
+	// apart from ones exactly at it, and dropped rather than truncated.
+	buf := make([]byte, maxDatagramSize+1)
 
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println(err)
 			continue
 		}
+		if n > maxDatagramSize {
+			oversizedRequests.Add(1)
+			continue
+		}
 
-		err = s.handleMessage(conn, addr, string(buf[:n]))
-		if err != nil {
+		msg := string(buf[:n])
+		queues[keyHash(s.requestKey(msg))%uint32(workers)] <- request{sender: addr, msg: msg}
+	}
+}
+
+func (s *Server) work(conn net.PacketConn, queue chan request) {
+	for req := range queue {
+		if err := s.handleMessage(conn, req.sender, req.msg); err != nil {
 			log.Println(err)
-			continue
 		}
 	}
 }
@@ -0,0 +1,278 @@
+package unusualdatabase
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t testing.TB, s *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go s.serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func dial(t testing.TB, addr string) net.Conn {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func roundTrip(t testing.TB, conn net.Conn, msg string) string {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1000)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestInsertRetrieve(t *testing.T) {
+	conn := dial(t, startServer(t, NewServer()))
+
+	tests := []struct {
+		Insert   string
+		Retrieve string
+		Expected string
+	}{
+		{Insert: "foo=bar", Retrieve: "foo", Expected: "foo=bar"},
+		{Insert: "foo=bar=baz", Retrieve: "foo", Expected: "foo=bar=baz"},
+		{Insert: "foo=", Retrieve: "foo", Expected: "foo="},
+		{Insert: "=foo", Retrieve: "", Expected: "=foo"},
+		{Insert: "version=nope", Retrieve: "version", Expected: "version=jesse's cool kv database 1.0"},
+		{Retrieve: "missing", Expected: "missing="},
+	}
+
+	for _, test := range tests {
+		if test.Insert != "" {
+			conn.Write([]byte(test.Insert))
+		}
+		assert.Equal(t, test.Expected, roundTrip(t, conn, test.Retrieve))
+	}
+}
+
+func TestOversizedDatagrams(t *testing.T) {
+	s := NewServer()
+	s.Extended = true
+	// One worker, so that the last request is answered after the others.
+	s.Workers = 1
+	conn := dial(t, startServer(t, s))
+
+	requests := oversizedRequests.Value()
+	conn.Write([]byte("big=" + strings.Repeat("x", maxDatagramSize)))
+	exact := "exact=" + strings.Repeat("x", maxDatagramSize-len("exact="))
+	conn.Write([]byte(exact))
+	assert.Equal(t, "big=", roundTrip(t, conn, "big"))
+	assert.Equal(t, exact, roundTrip(t, conn, "exact"))
+	assert.Equal(t, requests+1, oversizedRequests.Value())
+
+	// Values can grow past what fits in a reply, which is then not sent.
+	replies := oversizedReplies.Value()
+	conn.Write([]byte("!append exact=more"))
+	conn.Write([]byte("exact"))
+	assert.Equal(t, "small=", roundTrip(t, conn, "small"))
+	assert.Equal(t, replies+2, oversizedReplies.Value())
+}
+
+func TestBinaryKeysAndValues(t *testing.T) {
+	conn := dial(t, startServer(t, NewServer()))
+
+	for _, msg := range []string{"\xff\xfe=\x00\x80", "caf\xc3=\xa9", "\x00=\n\r"} {
+		conn.Write([]byte(msg))
+		key, _, _ := strings.Cut(msg, "=")
+		assert.Equal(t, msg, roundTrip(t, conn, key))
+	}
+}
+
+// Requests for one key are handled in order even with many workers, so a read
+// always sees the write sent just before it.
+func TestPerKeyOrdering(t *testing.T) {
+	s := NewServer()
+	s.Workers = 8
+	addr := startServer(t, s)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			conn := dial(t, addr)
+			key := fmt.Sprintf("key%d", c)
+			for i := 0; i < 50; i++ {
+				conn.Write([]byte(fmt.Sprintf("%s=%d", key, i)))
+				assert.Equal(t, fmt.Sprintf("%s=%d", key, i), roundTrip(t, conn, key))
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+func TestStoreConcurrentAccess(t *testing.T) {
+	st := NewStore()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%d-%d", c, i%100)
+				st.Set(key, "x")
+				val, ok := st.Get(key)
+				assert.True(t, ok)
+				assert.Equal(t, "x", val)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 800, st.Len())
+}
+
+func BenchmarkStore(b *testing.B) {
+	st := NewStore()
+	var next uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddUint64(&next, 1) << 32
+		for pb.Next() {
+			key := fmt.Sprint(i % 1024)
+			st.Set(key, "value")
+			st.Get(key)
+			i++
+		}
+	})
+}
+
+// BenchmarkServer measures round trips through a real socket. Compare runs
+// with -cpu 1,2,4,8 to see how throughput scales with the worker pool.
+func BenchmarkServer(b *testing.B) {
+	addr := startServer(b, NewServer())
+	var next uint64
+
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		conn := dial(b, addr)
+		key := fmt.Sprintf("key%d", atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			conn.Write([]byte(key + "=value"))
+			roundTrip(b, conn, key)
+		}
+	})
+	b.ReportMetric(float64(2*b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+func TestStoreExpiry(t *testing.T) {
+	st := NewStore()
+	t.Cleanup(func() { st.Close() })
+
+	st.SetWithTTL("brief", "x", 10*time.Millisecond)
+	st.Set("forever", "x")
+	assert.Equal(t, 2, st.Len())
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok := st.Get("brief")
+	assert.False(t, ok, "expired keys are hidden before they are swept")
+
+	st.expire(time.Now())
+	assert.Equal(t, 1, st.Len())
+}
+
+type recordingConn struct {
+	net.PacketConn
+	replies []string
+}
+
+func (c *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.replies = append(c.replies, string(p))
+	return len(p), nil
+}
+
+// FuzzHandleMessage checks the invariants of the protocol for any datagram:
+// there is at most one reply and it fits in a datagram, retrieves are always
+// answered with the key, and whatever an insert stores is read back exactly.
+func FuzzHandleMessage(f *testing.F) {
+	for _, msg := range []string{"foo=bar", "foo", "=", "", "version=x", "!incr n", "!scan 0 ", "!cas a k=b", "\xff=\x00", "_keys=1", "_memory=1"} {
+		f.Add(msg, false)
+		f.Add(msg, true)
+	}
+	f.Add(strings.Repeat("k", maxDatagramSize), false)
+
+	f.Fuzz(func(t *testing.T, msg string, extended bool) {
+		if len(msg) > maxDatagramSize {
+			return
+		}
+		s := NewServer()
+		s.Extended = extended
+		conn := &recordingConn{}
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+		if err := s.handleMessage(conn, addr, msg); err != nil {
+			t.Fatal(err)
+		}
+		if len(conn.replies) > 1 {
+			t.Fatalf("%q got %d replies", msg, len(conn.replies))
+		}
+		for _, reply := range conn.replies {
+			if len(reply) > maxDatagramSize {
+				t.Fatalf("%q got a reply of %d bytes", msg, len(reply))
+			}
+		}
+		if s.isExtended(msg) {
+			return
+		}
+
+		key, _, insert := strings.Cut(msg, "=")
+		if !insert {
+			// An empty value still adds "=", which can push the reply past
+			// the datagram limit, and then there is none.
+			if len(msg)+1 > maxDatagramSize && len(conn.replies) == 0 {
+				return
+			}
+			if len(conn.replies) != 1 || !strings.HasPrefix(conn.replies[0], msg+"=") {
+				t.Fatalf("retrieve %q got %q", msg, conn.replies)
+			}
+			return
+		}
+		if len(conn.replies) != 0 {
+			t.Fatalf("insert %q got %q", msg, conn.replies)
+		}
+
+		conn.replies = nil
+		if err := s.handleMessage(conn, addr, key); err != nil {
+			t.Fatal(err)
+		}
+		if isReadOnly(key) {
+			// Inserts are ignored, and the server keeps answering for the key.
+			if _, stored := s.Store.Get(key); stored {
+				t.Fatalf("insert %q was stored", msg)
+			}
+			if len(conn.replies) != 1 || !strings.HasPrefix(conn.replies[0], key+"=") {
+				t.Fatalf("insert %q then retrieve %q got %q", msg, key, conn.replies)
+			}
+			return
+		}
+		if len(conn.replies) != 1 || conn.replies[0] != msg {
+			t.Fatalf("insert %q then retrieve %q got %q, want %q", msg, key, conn.replies, msg)
+		}
+	})
+}
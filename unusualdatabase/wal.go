@@ -0,0 +1,241 @@
+package unusualdatabase
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs the log before a write is applied.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs the log every SyncInterval if it has changed.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system. Writes survive the
+	// process dying but not the machine.
+	SyncNever SyncPolicy = "never"
+)
+
+const (
+	opSet         byte = 1
+	opSetExpiring byte = 2
+	opDelete      byte = 3
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// Records in the log and in snapshots are framed as a big endian length and
+// CRC-32 of the payload, followed by the payload: an op byte, the key length
+// as a uvarint, the key and the value.
+func encodeRecord(op byte, key, val string) []byte {
+	payload := make([]byte, 0, 1+binary.MaxVarintLen64+len(key)+len(val))
+	payload = append(payload, op)
+	payload = binary.AppendUvarint(payload, uint64(len(key)))
+	payload = append(payload, key...)
+	payload = append(payload, val...)
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+// readRecords calls fn for every intact record in r. It returns the number of
+// bytes making up those records, and errCorruptRecord if it stopped early
+// because of a torn or damaged record, or any other error from r.
+func readRecords(r io.Reader, fn func(op byte, key, val string)) (int64, error) {
+	br := bufio.NewReader(r)
+	var good int64
+
+	for {
+		op, key, val, size, err := readRecord(br)
+		if err == io.EOF {
+			return good, nil
+		} else if err != nil {
+			return good, err
+		}
+		fn(op, key, val)
+		good += size
+	}
+}
+
+// readRecord reads the next record from br, returning its size in bytes. It
+// returns io.EOF only if br ends cleanly before the record starts.
+func readRecord(br *bufio.Reader) (op byte, key, val string, size int64, err error) {
+	var header [8]byte
+	if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+		return 0, "", "", 0, io.EOF
+	} else if err != nil {
+		return 0, "", "", 0, truncatedRecord(err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return 0, "", "", 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, "", "", 0, truncatedRecord(err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, "", "", 0, errCorruptRecord
+	}
+
+	if len(payload) < 1 {
+		return 0, "", "", 0, errCorruptRecord
+	}
+	keyLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 || uint64(len(payload)-1-n) < keyLen {
+		return 0, "", "", 0, errCorruptRecord
+	}
+	key = string(payload[1+n : 1+n+int(keyLen)])
+	val = string(payload[1+n+int(keyLen):])
+	return payload[0], key, val, int64(len(header)) + int64(length), nil
+}
+
+func truncatedRecord(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorruptRecord
+	}
+	return err
+}
+
+// maxRecordSize is far larger than anything a datagram can carry, and only
+// guards against allocating huge buffers for garbage lengths.
+const maxRecordSize = 1 << 20
+
+func walPath(dir string, gen uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("wal.%d", gen))
+}
+
+func snapshotPath(dir string, gen uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("snapshot.%d", gen))
+}
+
+type writeAheadLog struct {
+	dir    string
+	policy SyncPolicy
+	gen    uint64
+	file   *os.File
+	size   int64
+	dirty  bool
+	mu     sync.Mutex
+}
+
+func createWAL(dir string, gen uint64, policy SyncPolicy) (*writeAheadLog, error) {
+	w := &writeAheadLog{dir: dir, policy: policy}
+	if err := w.open(gen); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *writeAheadLog) open(gen uint64) error {
+	file, err := os.OpenFile(walPath(w.dir, gen), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.gen = gen
+	w.file = file
+	w.size = 0
+	w.dirty = false
+	return nil
+}
+
+// append writes one encoded record and returns the size of the log
+// afterwards.
+func (w *writeAheadLog) append(record []byte) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(record); err != nil {
+		return w.size, err
+	}
+	w.size += int64(len(record))
+
+	if w.policy == SyncAlways {
+		return w.size, w.file.Sync()
+	}
+	w.dirty = true
+	return w.size, nil
+}
+
+func (w *writeAheadLog) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// rotate closes the current log file and starts the next generation, which it
+// returns. Records in earlier generations can then be folded into a snapshot.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	if err := w.open(w.gen + 1); err != nil {
+		return 0, err
+	}
+	return w.gen, nil
+}
+
+func (w *writeAheadLog) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *writeAheadLog) syncEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				log.Println("wal sync:", err)
+			}
+		}
+	}
+}
+
+// syncDir makes file creations and renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
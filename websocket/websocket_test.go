@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			conn.Write([]byte(strings.ToUpper(scanner.Text()) + "\n"))
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(srv.URL, "http"))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	assert.Nil(t, conn.WriteMessage(OpPing, []byte("ping")))
+	assert.Nil(t, conn.WriteMessage(OpText, []byte(strings.Repeat("a", 200))))
+	_, err = conn.Write([]byte("one\ntwo\n"))
+	assert.Nil(t, err)
+
+	for _, want := range []string{strings.Repeat("A", 200), "ONE", "TWO"} {
+		op, msg, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, OpText, op)
+		assert.Equal(t, want, string(msg))
+	}
+}
+
+func TestUpgradeRejectsPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(w, r)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}